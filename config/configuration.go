@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"sync/atomic"
 
 	"dario.cat/mergo"
@@ -20,36 +21,133 @@ type Configuration struct {
 		WatchDirectories bool     `default:"true" json:"watch_directories"`
 		StrictMode       bool     `default:"true" json:"strict_mode"`
 		PrintTo          string   `default:"stdout" json:"print_to"`
+		Shadow           struct {
+			Directories         []string `default:"[]" json:"directories"`
+			TimeoutMilliseconds int      `default:"1000" json:"timeout_milliseconds"`
+			MaxConcurrent       int      `default:"4" json:"max_concurrent"`
+		} `json:"shadow"`
+		Profiling struct {
+			Enabled     bool `default:"false" json:"enabled"`
+			SampleEvery int  `default:"100" json:"sample_every"`
+			TopN        int  `default:"20" json:"top_n"`
+		} `json:"profiling"`
+		Coverage struct {
+			Enabled bool `default:"false" json:"enabled"`
+		} `json:"coverage"`
 	} `json:"policy"`
 	Reflection struct {
 		Enabled bool `default:"true" json:"enabled"`
 	} `json:"reflection"`
+	Health struct {
+		Enabled               bool `default:"true" json:"enabled"`
+		RequireLatestPolicies bool `default:"false" json:"require_latest_policies"`
+	} `json:"health"`
 	Authorizer struct {
 		IncludesMetrics bool `default:"false" json:"includes_metrics"`
+		IncludesAdmin   bool `default:"false" json:"includes_admin"`
 		Listener        struct {
-			Type    string `default:"unix" json:"type"`
-			Address string `default:"./serve.sock" json:"address"`
+			Type    string      `default:"unix" json:"type"`
+			Address string      `default:"./serve.sock" json:"address"`
+			Tls     ListenerTLS `json:"tls"`
 		} `json:"listener"`
 	} `json:"authorizer"`
+	Admin struct {
+		IncludesMetrics bool `default:"false" json:"includes_metrics"`
+		Listener        struct {
+			Type    string      `default:"unix" json:"type"`
+			Address string      `default:"./admin.sock" json:"address"`
+			Tls     ListenerTLS `json:"tls"`
+		} `json:"listener"`
+		Authentication struct {
+			Enabled                   bool     `default:"false" json:"enabled"`
+			TokenFiles                []string `default:"[]" json:"token_files"`
+			UnixUsers                 []string `default:"[]" json:"unix_users"`
+			UnixGroups                []string `default:"[]" json:"unix_groups"`
+			ClientCertificateSubjects []string `default:"[]" json:"client_certificate_subjects"`
+		} `json:"authentication"`
+	} `json:"admin"`
 	Metrics struct {
 		Enabled  bool   `default:"true" json:"enabled"`
 		Path     string `default:"/metrics" json:"path"`
 		Listener struct {
-			Type    string `default:"tcp" json:"type"`
-			Address string `default:":9100" json:"address"`
+			Type    string      `default:"tcp" json:"type"`
+			Address string      `default:":9100" json:"address"`
+			Tls     ListenerTLS `json:"tls"`
 		} `json:"listener"`
 	} `json:"metrics"`
+	Server struct {
+		ReadHeaderTimeoutSeconds int `default:"10" json:"read_header_timeout_seconds"`
+		IdleTimeoutSeconds       int `default:"120" json:"idle_timeout_seconds"`
+		DrainTimeoutSeconds      int `default:"10" json:"drain_timeout_seconds"`
+	} `json:"server"`
 	Reload struct {
 		Configuration bool `default:"true" json:"configuration"`
 		Policies      bool `default:"true" json:"policies"`
 		ReopenLogFile bool `default:"true" json:"reopen_log_file"`
 	} `json:"reload"`
 	Log struct {
-		Filename string   `default:"stderr" json:"filename"`
-		Level    string   `default:"info" json:"level"`
-		Input    []string `default:"[]" json:"input"`
-		Result   []string `default:"[\"ok\"]" json:"result"`
+		Filename string      `default:"stderr" json:"filename"`
+		Format   string      `default:"json" json:"format"`
+		Level    string      `default:"info" json:"level"`
+		Input    []string    `default:"[]" json:"input"`
+		Result   []string    `default:"[\"ok\"]" json:"result"`
+		Rotation LogRotation `json:"rotation"`
 	} `json:"log"`
+	Tracing struct {
+		Enabled        bool   `default:"false" json:"enabled"`
+		Endpoint       string `default:"http://localhost:4318/v1/traces" json:"endpoint"`
+		TimeoutSeconds int    `default:"10" json:"timeout_seconds"`
+		Sampler        string `default:"parentbased_always_on" json:"sampler"`
+		SamplerArg     string `default:"1.0" json:"sampler_arg"`
+		ServiceName    string `default:"docker-socket-authorizer" json:"service_name"`
+	} `json:"tracing"`
+	Redaction struct {
+		Mask []string `default:"[\"input.request.headers.authorization\", \"input.request.headers.proxy-authorization\", \"input.request.headers.cookie\", \"input.request.headers.x-registry-auth\", \"input.request.headers.x-registry-config\"]" json:"mask"`
+		Drop []string `default:"[]" json:"drop"`
+		Hash []string `default:"[]" json:"hash"`
+	} `json:"redaction"`
+	DecisionLog struct {
+		Enabled   bool        `default:"false" json:"enabled"`
+		Filename  string      `default:"./decisions.log" json:"filename"`
+		Rotation  LogRotation `json:"rotation"`
+		HashChain struct {
+			Enabled            bool   `default:"false" json:"enabled"`
+			CheckpointKeyFile  string `default:"" json:"checkpoint_key_file"`
+			CheckpointInterval int    `default:"1000" json:"checkpoint_interval"`
+		} `json:"hash_chain"`
+		Upload struct {
+			Url                     string `default:"" json:"url"`
+			BatchSize               int    `default:"100" json:"batch_size"`
+			FlushIntervalSeconds    int    `default:"5" json:"flush_interval_seconds"`
+			BufferSize              int    `default:"10000" json:"buffer_size"`
+			BufferDirectory         string `default:"" json:"buffer_directory"`
+			BufferDirectoryMaxBytes int    `default:"104857600" json:"buffer_directory_max_bytes"`
+			TimeoutSeconds          int    `default:"10" json:"timeout_seconds"`
+			MinBackoffSeconds       int    `default:"1" json:"min_backoff_seconds"`
+			MaxBackoffSeconds       int    `default:"300" json:"max_backoff_seconds"`
+		} `json:"upload"`
+	} `json:"decision_log"`
+	Storage struct {
+		MaxBytesPerPolicy int    `default:"0" json:"max_bytes_per_policy"`
+		MaxTotalBytes     int    `default:"0" json:"max_total_bytes"`
+		OnQuotaExceeded   string `default:"reject" json:"on_quota_exceeded"`
+	} `json:"storage"`
+}
+
+// Settings for rotating a log file in-process, which happens if MaxBytes or MaxAgeSeconds is set
+type LogRotation struct {
+	MaxBytes      int  `default:"0" json:"max_bytes"`
+	MaxAgeSeconds int  `default:"0" json:"max_age_seconds"`
+	MaxBackups    int  `default:"5" json:"max_backups"`
+	Compress      bool `default:"false" json:"compress"`
+}
+
+// TLS settings for a listener, which uses TLS if CertificateFile is set
+type ListenerTLS struct {
+	CertificateFile string `default:"" json:"certificate_file"`
+	KeyFile         string `default:"" json:"key_file"`
+	ClientCaFile    string `default:"" json:"client_ca_file"`
+	MinVersion      string `default:"1.2" json:"min_version"`
 }
 
 // Thread safe: we atomically swap in the new ConfigurationPointer object; while
@@ -66,7 +164,7 @@ func LoadConfiguration() (*Configuration, error) {
 	}
 	if err := mergo.Map(
 		newConfiguration,
-		viper.AllSettings(),
+		camelCaseKeys(viper.AllSettings()),
 		mergo.WithOverride,
 		mergo.WithTypeCheck,
 		mergo.WithTransformers(
@@ -95,6 +193,25 @@ func DefaultConfiguration() *Configuration {
 	return newConfiguration
 }
 
+// Returns a copy of settings with every key (recursively) converted from snake_case to CamelCase, so that mergo can
+// match keys like "watch_directories" to the corresponding field (WatchDirectories).
+func camelCaseKeys(settings map[string]interface{}) map[string]interface{} {
+	output := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = camelCaseKeys(nested)
+		}
+		words := strings.Split(key, "_")
+		for i, word := range words {
+			if word != "" {
+				words[i] = strings.ToUpper(word[:1]) + word[1:]
+			}
+		}
+		output[strings.Join(words, "")] = value
+	}
+	return output
+}
+
 type stringListTransformer struct {
 	logger *slog.Logger
 }
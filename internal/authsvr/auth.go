@@ -0,0 +1,161 @@
+package authsvr
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// The principal recorded for admin requests when admin.authentication is disabled
+const ANONYMOUS_PRINCIPAL = "anonymous"
+
+type peerCredentialsKeyT struct{}
+
+var peerCredentialsKey peerCredentialsKeyT = peerCredentialsKeyT{}
+
+// The credentials of the process on the other end of a unix socket connection
+type peerCredentials struct {
+	uid int
+	gid int
+}
+
+// Records the peer credentials of unix socket connections in their context, for authenticating admin requests. Used as
+// http.Server.ConnContext.
+func withPeerCredentials(ctx context.Context, c net.Conn) context.Context {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	credentials, err := getPeerCredentials(unixConn)
+	if err != nil {
+		slog.Debug("Unable to get unix socket peer credentials", slog.Any("error", err))
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey, credentials)
+}
+
+// Requires admin requests to be authenticated (if admin.authentication.enabled is set), and logs every admin request
+// along with the principal that made it.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.ConfigurationPointer.Load()
+		logger := slog.With(slog.String("method", r.Method), slog.String("path", r.URL.Path), slog.String("remote_addr", r.RemoteAddr))
+
+		principal := ANONYMOUS_PRINCIPAL
+		if cfg.Admin.Authentication.Enabled {
+			var err error
+			principal, err = authenticate(r, cfg)
+			if err != nil {
+				logger.Warn("Admin request not authenticated", slog.Any("error", err))
+				w.Header().Add("www-authenticate", "Bearer")
+				w.Header().Add("content-type", "text/plain")
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, "Unauthorized")
+				return
+			}
+			// A bearer token is the admin's own credential rather than part of a request being inspected, so it must
+			// not reach handlers which build an input from the request (such as /reflection/explain) and echo it back
+			if len(cfg.Admin.Authentication.TokenFiles) > 0 && strings.HasPrefix(r.Header.Get("authorization"), "Bearer ") {
+				r.Header.Del("authorization")
+			}
+		}
+
+		logger.Info("Admin request", slog.String("principal", principal))
+		handler(w, r)
+	}
+}
+
+// Returns the principal that made r, trying each configured method of authentication in turn: a bearer token, the
+// unix socket peer, then the TLS client certificate. The first to succeed is used, so a wrong bearer token doesn't
+// prevent the other methods from succeeding. Principals are prefixed by the method that authenticated them.
+func authenticate(r *http.Request, cfg *config.Configuration) (string, error) {
+	authentication := cfg.Admin.Authentication
+	failure := fmt.Errorf("no configured method of authentication succeeded")
+
+	if token, ok := strings.CutPrefix(r.Header.Get("authorization"), "Bearer "); ok && len(authentication.TokenFiles) > 0 {
+		if name, ok := matchToken(strings.TrimSpace(token), authentication.TokenFiles); ok {
+			return "token:" + name, nil
+		}
+		failure = fmt.Errorf("bearer token does not match any of admin.authentication.token_files, and no other configured method of authentication succeeded")
+	}
+
+	if credentials, ok := r.Context().Value(peerCredentialsKey).(peerCredentials); ok {
+		if name, ok := matchPeer(credentials, authentication.UnixUsers, authentication.UnixGroups); ok {
+			return "unix:" + name, nil
+		}
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(authentication.ClientCertificateSubjects) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		if slices.Contains(authentication.ClientCertificateSubjects, subject.String()) || slices.Contains(authentication.ClientCertificateSubjects, "CN="+subject.CommonName) {
+			return "certificate:" + subject.String(), nil
+		}
+	}
+
+	return "", failure
+}
+
+// Returns the name of the file (without its directory) containing token, if any. Each file contains a single token;
+// they are read on every request, so they can be changed without reloading.
+func matchToken(token string, files []string) (string, bool) {
+	matched := ""
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			slog.Warn("Unable to read admin token file", slog.String("file", file), slog.Any("error", err))
+			continue
+		}
+		expected := strings.TrimSpace(string(contents))
+		// Compare against every file, so timing doesn't reveal which (if any) matched
+		if expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 && matched == "" {
+			matched = filepath.Base(file)
+		}
+	}
+	return matched, matched != ""
+}
+
+// Returns a description of the peer if it is one of users (by name or uid), or in one of groups (by name or gid, as
+// either its primary or a supplementary group).
+func matchPeer(credentials peerCredentials, users []string, groups []string) (string, bool) {
+	uid, gid := strconv.Itoa(credentials.uid), strconv.Itoa(credentials.gid)
+	name := "uid=" + uid
+	peerUser, err := user.LookupId(uid)
+	if err == nil {
+		name += "(" + peerUser.Username + ")"
+	}
+
+	if slices.Contains(users, uid) || (peerUser != nil && slices.Contains(users, peerUser.Username)) {
+		return name, true
+	}
+
+	groupIds := []string{gid}
+	if peerUser != nil {
+		if supplementary, err := peerUser.GroupIds(); err == nil {
+			groupIds = append(groupIds, supplementary...)
+		}
+	}
+	for _, groupId := range groupIds {
+		if slices.Contains(groups, groupId) {
+			return name + ",gid=" + groupId, true
+		}
+		if group, err := user.LookupGroupId(groupId); err == nil && slices.Contains(groups, group.Name) {
+			return name + ",gid=" + groupId + "(" + group.Name + ")", true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,170 @@
+package authsvr
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Configuration{}
+	cfg.Admin.Authentication.Enabled = true
+	cfg.Admin.Authentication.TokenFiles = []string{tokenFile}
+	cfg.Admin.Authentication.UnixUsers = []string{"1234"}
+	cfg.Admin.Authentication.ClientCertificateSubjects = []string{"CN=admin"}
+
+	admin := &x509.Certificate{Subject: pkix.Name{CommonName: "admin", Organization: []string{"Example"}}}
+	other := &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}
+
+	tests := []struct {
+		name        string
+		token       string
+		peer        *peerCredentials
+		certificate *x509.Certificate
+		principal   string
+		errContains string
+	}{
+		{name: "token", token: "secret", principal: "token:admin-token"},
+		{name: "token with whitespace", token: " secret ", principal: "token:admin-token"},
+		{name: "unix peer", peer: &peerCredentials{uid: 1234, gid: 1234}, principal: "unix:uid=1234"},
+		{name: "certificate", certificate: admin, principal: "certificate:CN=admin,O=Example"},
+		{name: "wrong token falls through to unix peer", token: "wrong", peer: &peerCredentials{uid: 1234, gid: 1234}, principal: "unix:uid=1234"},
+		{name: "wrong token falls through to certificate", token: "wrong", certificate: admin, principal: "certificate:CN=admin,O=Example"},
+		{name: "wrong token alone", token: "wrong", errContains: "bearer token does not match"},
+		{name: "unknown unix peer", peer: &peerCredentials{uid: 4321, gid: 4321}, errContains: "no configured method"},
+		{name: "unknown certificate", certificate: other, errContains: "no configured method"},
+		{name: "nothing", errContains: "no configured method"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/reflection/policies", nil)
+			if test.token != "" {
+				r.Header.Set("authorization", "Bearer "+test.token)
+			}
+			if test.peer != nil {
+				r = r.WithContext(context.WithValue(r.Context(), peerCredentialsKey, *test.peer))
+			}
+			if test.certificate != nil {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{test.certificate}}}
+			}
+
+			principal, err := authenticate(r, cfg)
+			if test.errContains != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errContains) {
+					t.Fatalf("expected error containing %q, got principal %q and error %v", test.errContains, principal, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected principal %q, got error %v", test.principal, err)
+			}
+			// The uid may have a username appended if it exists on this machine
+			if principal != test.principal && !strings.HasPrefix(principal, test.principal+"(") {
+				t.Fatalf("expected principal %q, got %q", test.principal, principal)
+			}
+		})
+	}
+}
+
+func TestRequireAdminHidesToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DefaultConfiguration()
+	cfg.Admin.Authentication.Enabled = true
+	cfg.Admin.Authentication.TokenFiles = []string{tokenFile}
+	cfg.Admin.Authentication.ClientCertificateSubjects = []string{"CN=admin"}
+	config.ConfigurationPointer.Store(cfg)
+	admin := &x509.Certificate{Subject: pkix.Name{CommonName: "admin"}}
+
+	tests := []struct {
+		name          string
+		authorization string
+	}{
+		{name: "matching token", authorization: "Bearer secret"},
+		{name: "wrong token with certificate", authorization: "Bearer wrong"},
+		{name: "basic credentials with certificate", authorization: "Basic dXNlcjpwYXNz"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := ""
+			handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+				seen = r.Header.Get("authorization")
+			})
+			r := httptest.NewRequest("GET", "/reflection/explain", nil)
+			r.Header.Set("authorization", test.authorization)
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{admin}}}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			expected := ""
+			if !strings.HasPrefix(test.authorization, "Bearer ") {
+				expected = test.authorization
+			}
+			if seen != expected {
+				t.Fatalf("expected handler to see authorization %q, got %q", expected, seen)
+			}
+		})
+	}
+}
+
+func TestMatchPeer(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("unable to look up current user: %v", err)
+	}
+	uid, _ := strconv.Atoi(current.Uid)
+	gid, _ := strconv.Atoi(current.Gid)
+	credentials := peerCredentials{uid: uid, gid: gid}
+	group, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Skipf("unable to look up current group: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		users   []string
+		groups  []string
+		matches bool
+	}{
+		{name: "uid", users: []string{current.Uid}, matches: true},
+		{name: "username", users: []string{current.Username}, matches: true},
+		{name: "gid", groups: []string{current.Gid}, matches: true},
+		{name: "group name", groups: []string{group.Name}, matches: true},
+		{name: "other user and group", users: []string{"no-such-user"}, groups: []string{"no-such-group"}, matches: false},
+		{name: "nothing configured", matches: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, ok := matchPeer(credentials, test.users, test.groups)
+			if ok != test.matches {
+				t.Fatalf("expected match %v, got %v (%q)", test.matches, ok, name)
+			}
+			if ok && !strings.HasPrefix(name, "uid="+current.Uid) {
+				t.Fatalf("expected name to start with uid=%s, got %q", current.Uid, name)
+			}
+		})
+	}
+}
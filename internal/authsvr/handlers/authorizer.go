@@ -1,23 +1,61 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"reflect"
+	"sync/atomic"
+	"time"
 
 	"github.com/mjec/docker-socket-authorizer/config"
 	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/decisionlog"
+	"github.com/mjec/docker-socket-authorizer/internal/dockerapi"
+	"github.com/mjec/docker-socket-authorizer/internal/jsonpath"
 	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/mjec/docker-socket-authorizer/internal/redact"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slog"
 
+	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func Authorize(w http.ResponseWriter, r *http.Request) {
-	var contextualLogger *slog.Logger = slog.Default()
+	decision := decisionlog.NewDecision(time.Now(), r.RemoteAddr)
+	defer decisionlog.Log(decision)
+
+	// Continues the trace from an incoming traceparent header, if there is one
+	ctx, span := o11y.Tracer.Start(
+		otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header)),
+		"authorize",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("decision_id", decision.DecisionID)),
+	)
+	defer func() {
+		if decision.Error != nil {
+			span.SetStatus(codes.Error, decision.Error.Message)
+		}
+		span.End()
+	}()
+
+	var contextualLogger *slog.Logger = slog.Default().With(slog.String("decision_id", decision.DecisionID))
+	if span.SpanContext().IsSampled() {
+		contextualLogger = contextualLogger.With(slog.String("trace_id", span.SpanContext().TraceID().String()))
+	}
 	cfg := config.ConfigurationPointer.Load()
+	_, endInputPhase := startPhase(ctx, "input")
 	input, err := internal.MakeInput(r)
+	endInputPhase()
 	if err != nil {
+		decision.SetError("internal_error", err)
 		contextualLogger.Error("Error making input", slog.Any("error", err))
 		o11y.Metrics.Errors.Inc()
 		w.WriteHeader(http.StatusInternalServerError)
@@ -25,30 +63,45 @@ func Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(cfg.Log.Input) == 1 && cfg.Log.Input[0] == "*" {
-		contextualLogger = contextualLogger.With(slog.Any("input", input))
-	} else if len(cfg.Log.Input) > 0 {
-		inputToLog := make(map[string]interface{}, len(cfg.Log.Input))
-
-		inputElem := reflect.ValueOf(input).Elem()
-		typeOfInput := inputElem.Type()
-		for i := 0; i < inputElem.NumField(); i++ {
-			for _, key := range cfg.Log.Input {
-				if key == typeOfInput.Field(i).Name {
-					inputToLog[key] = inputElem.Field(i).Interface()
-					break
-				}
-			}
+	if len(cfg.Log.Input) > 0 {
+		if inputToLog, err := fieldsToLog("input", input, currentLogPaths().input); err != nil {
+			contextualLogger.Error("Unable to redact input for logging; not logging it", slog.Any("error", err))
+		} else {
+			contextualLogger = contextualLogger.With(slog.Any("input", inputToLog))
 		}
-
-		contextualLogger = contextualLogger.With(slog.Any("input", inputToLog))
 	}
 
 	// It's important we clone the pointer here! Otherwise we'll be racing with policy reloads
 	evaluator := internal.Evaluator.Load()
+	decision.Input = input
+	decision.SetRevision(evaluator.Revision())
 
-	resultSet, err := evaluator.EvaluateQuery(r.Context(), rego.EvalInput(input))
+	evalMetrics := metrics.New()
+	ndBuiltinCache := builtins.NDBCache{}
+	evaluationCtx, endEvaluationPhase := startPhase(ctx, "evaluation")
+	evalOptions := []rego.EvalOption{rego.EvalInput(input), rego.EvalMetrics(evalMetrics), rego.EvalNDBuiltinCache(ndBuiltinCache)}
+	profiler := internal.SampleProfiler()
+	if profiler != nil {
+		evalOptions = append(evalOptions, rego.EvalQueryTracer(profiler))
+	}
+	coverageTracer := internal.CoverageTracerIfEnabled()
+	if coverageTracer != nil {
+		evalOptions = append(evalOptions, rego.EvalQueryTracer(coverageTracer))
+	}
+	resultSet, err := evaluator.EvaluateQuery(internal.LiveEvaluationContext(evaluationCtx), evalOptions...)
+	endEvaluationPhase()
+	if profiler != nil && err == nil {
+		internal.RecordProfile(evaluator, profiler)
+	}
+	if coverageTracer != nil && err == nil {
+		internal.RecordCoverage(evaluator, coverageTracer)
+	}
+	maps.Copy(decision.Metrics, evalMetrics.All())
+	if len(ndBuiltinCache) > 0 {
+		decision.NDBuiltinCache = ndBuiltinCache
+	}
 	if err != nil {
+		decision.SetError("evaluation_error", err)
 		contextualLogger.Error("Error evaluating policy", slog.Any("error", err))
 		o11y.Metrics.Errors.Inc()
 		w.WriteHeader(http.StatusInternalServerError)
@@ -56,20 +109,34 @@ func Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(cfg.Log.Result) == 1 && cfg.Log.Result[0] == "*" {
-		contextualLogger = contextualLogger.With(slog.Any("result", resultSet[0].Bindings))
-	} else if len(cfg.Log.Result) > 0 {
-		bindingsToLog := make(map[string]interface{}, len(cfg.Log.Result))
-		for _, key := range cfg.Log.Result {
-			if value, hasKey := resultSet[0].Bindings[key]; hasKey {
-				bindingsToLog[key] = value
-			}
-		}
+	// This may modify the bindings (including the ok output), so must be done before we log or act on them
+	if err := internal.EnforceStorageQuotas(evaluator, resultSet[0].Bindings, contextualLogger); err != nil {
+		decision.SetError("internal_error", err)
+		contextualLogger.Error("Error enforcing storage quotas", slog.Any("error", err))
+		o11y.Metrics.Errors.Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+		return
+	}
+
+	recordPolicyResults(resultSet[0].Bindings)
+	internal.RecordPolicyMetrics(evaluator, resultSet[0].Bindings, contextualLogger)
 
-		contextualLogger = contextualLogger.With(slog.Any("result", bindingsToLog))
+	if len(cfg.Log.Result) > 0 {
+		if bindingsToLog, err := fieldsToLog("result", resultSet[0].Bindings, currentLogPaths().result); err != nil {
+			contextualLogger.Error("Unable to redact result for logging; not logging it", slog.Any("error", err))
+		} else {
+			contextualLogger = contextualLogger.With(slog.Any("result", bindingsToLog))
+		}
 	}
 
-	if err := evaluator.WriteToStorage(r.Context(), resultSet[0].Bindings["to_store"].(map[string]interface{})); err != nil {
+	decision.Result = resultSet[0].Bindings
+
+	storageCtx, endStoragePhase := startPhase(ctx, "storage")
+	err = evaluator.WriteToStorage(storageCtx, resultSet[0].Bindings["to_store"].(map[string]interface{}))
+	endStoragePhase()
+	if err != nil {
+		decision.SetError("internal_error", err)
 		contextualLogger.Error("Error writing to storage", slog.Any("error", err))
 		o11y.Metrics.Errors.Inc()
 		w.WriteHeader(http.StatusInternalServerError)
@@ -77,10 +144,19 @@ func Authorize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	evaluateShadow(decision.DecisionID, input, ndBuiltinCache, resultSet[0].Bindings)
+
 	// NOTE: do NOT use `resultSet.Allowed()`!
 	// The query is not set up for that. Always explicitly check the `ok` output.
+	originalMethod, originalUri := r.Header.Get("x-original-method"), r.Header.Get("x-original-uri")
+	method, operation := dockerapi.Method(originalMethod), dockerapi.Operation(originalMethod, originalUri)
+	span.SetAttributes(
+		attribute.String("docker.operation", operation),
+		attribute.Bool("ok", resultSet[0].Bindings["ok"].(bool)),
+	)
 	if resultSet[0].Bindings["ok"].(bool) {
 		o11y.Metrics.Approved.Inc()
+		o11y.Metrics.ApprovedOperations.WithLabelValues(method, operation).Inc()
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "OK")
 		contextualLogger.Info("Request processed")
@@ -89,7 +165,92 @@ func Authorize(w http.ResponseWriter, r *http.Request) {
 
 	// deny by default (in particular, in case we forgot a `return` somewhere above)
 	o11y.Metrics.Denied.Inc()
+	o11y.Metrics.DeniedOperations.WithLabelValues(method, operation).Inc()
 	w.WriteHeader(http.StatusForbidden)
 	fmt.Fprintln(w, "Forbidden")
 	contextualLogger.Info("Request processed")
 }
+
+// Times a phase of handling an authorization request, both in the authorization_phase_seconds metric and as a span
+// named after the phase. The returned function must be called when the phase is complete.
+func startPhase(ctx context.Context, phase string) (context.Context, func()) {
+	timer := prometheus.NewTimer(o11y.Metrics.AuthorizationPhaseTimer.WithLabelValues(phase))
+	ctx, span := o11y.Tracer.Start(ctx, phase)
+	return ctx, func() {
+		timer.ObserveDuration()
+		span.End()
+	}
+}
+
+// Counts the result of each policy, from the allows, denies, skips, invalid_policies and invalid_storage outputs. A
+// policy with invalid storage is counted as invalid rather than by its result, so this must be called after
+// EnforceStorageQuotas (which may add to invalid_storage).
+func recordPolicyResults(bindings map[string]interface{}) {
+	invalid := map[string]bool{}
+	for _, binding := range []string{"invalid_policies", "invalid_storage"} {
+		policies, _ := bindings[binding].([]interface{})
+		for _, policy := range policies {
+			invalid[fmt.Sprint(policy)] = true
+		}
+	}
+	for policy := range invalid {
+		o11y.Metrics.PolicyResults.WithLabelValues(policy, "invalid").Inc()
+	}
+	for binding, result := range map[string]string{"allows": "allow", "denies": "deny", "skips": "skip"} {
+		policies, _ := bindings[binding].(map[string]interface{})
+		for policy := range policies {
+			if !invalid[policy] {
+				o11y.Metrics.PolicyResults.WithLabelValues(policy, result).Inc()
+			}
+		}
+	}
+}
+
+// The paths in log.input and log.result, parsed once per configuration load
+type logPaths struct {
+	cfg    *config.Configuration
+	input  []jsonpath.Path
+	result []jsonpath.Path
+}
+
+var cachedLogPaths atomic.Pointer[logPaths] = atomic.Pointer[logPaths]{}
+
+func currentLogPaths() *logPaths {
+	cfg := config.ConfigurationPointer.Load()
+	if p := cachedLogPaths.Load(); p != nil && p.cfg == cfg {
+		return p
+	}
+
+	p := &logPaths{cfg: cfg, input: parseLogPaths("log.input", cfg.Log.Input), result: parseLogPaths("log.result", cfg.Log.Result)}
+	// If we lose this race, we'll just parse again next time
+	cachedLogPaths.Store(p)
+	return p
+}
+
+// Parses a list of paths to log, where "*" alone means everything
+func parseLogPaths(name string, fields []string) []jsonpath.Path {
+	if len(fields) == 1 && fields[0] == "*" {
+		// The empty path selects the whole document
+		return []jsonpath.Path{{}}
+	}
+	paths, err := jsonpath.ParseAll(fields)
+	if err != nil {
+		slog.Warn("Ignoring invalid paths in "+name, slog.Any("error", err))
+	}
+	return paths
+}
+
+// Returns the parts of value that should be logged, given a list of paths. Redaction rules are applied as they would
+// be in the decision log, where value is found under documentKey; but the paths to log are relative to value itself.
+func fieldsToLog(documentKey string, value interface{}, paths []jsonpath.Path) (interface{}, error) {
+	redacted, _, _, err := redact.Redact(map[string]interface{}{documentKey: value})
+	if err != nil {
+		return nil, err
+	}
+
+	selected := jsonpath.Select(redacted.(map[string]interface{})[documentKey], paths)
+	if selected == nil {
+		return map[string]interface{}{}, nil
+	}
+	return selected, nil
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const TEST_POLICY = `package docker_socket_authorizer.test
+
+default result := "allow"
+default message := "Allowed"
+
+# Calls a custom builtin, so it is traced as a child of the evaluation
+addresses := dns.a("localhost")
+`
+
+// A stand-in for an OTLP/HTTP collector, which records every span it receives
+type spanCollector struct {
+	mutex  *sync.Mutex
+	spans  []*tracepb.Span
+	errors []string
+}
+
+func (c *spanCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var body io.Reader = r.Body
+	if r.Header.Get("content-encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			c.errors = append(c.errors, err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	serialized, err := io.ReadAll(body)
+	if err != nil {
+		c.errors = append(c.errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var request collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(serialized, &request); err != nil {
+		c.errors = append(c.errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+
+	response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Header().Set("content-type", "application/x-protobuf")
+	w.Write(response)
+}
+
+func TestAuthorizeTracing(t *testing.T) {
+	c := &spanCollector{mutex: &sync.Mutex{}}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	policyDirectory := t.TempDir()
+	if err := os.WriteFile(filepath.Join(policyDirectory, "test.rego"), []byte(TEST_POLICY), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DefaultConfiguration()
+	cfg.Policy.Directories = []string{policyDirectory}
+	cfg.Tracing.Enabled = true
+	cfg.Tracing.Endpoint = server.URL + "/v1/traces"
+	cfg.Tracing.Sampler = "always_on"
+	config.ConfigurationPointer.Store(cfg)
+	if err := internal.LoadPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	if err := o11y.InitializeTracing(cfg); err != nil {
+		t.Fatal(err)
+	}
+	provider := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	// The global tracer only delegates to the first provider set, so this would otherwise only work once per process
+	tracer := o11y.Tracer
+	o11y.Tracer = provider.Tracer(o11y.TRACER_NAME)
+	defer func() {
+		o11y.Tracer = tracer
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		provider.Shutdown(context.Background())
+	}()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentSpanID = "00f067aa0ba902b7"
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	r.Header.Set("x-original-method", "GET")
+	r.Header.Set("x-original-uri", "/v1.43/containers/json")
+	w := httptest.NewRecorder()
+	Authorize(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the request to be allowed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.errors) > 0 {
+		t.Fatalf("collector received invalid exports: %v", c.errors)
+	}
+
+	spans := map[string]*tracepb.Span{}
+	for _, span := range c.spans {
+		if hex.EncodeToString(span.TraceId) != traceID {
+			t.Fatalf("expected span %s to continue trace %s, got %x", span.Name, traceID, span.TraceId)
+		}
+		spans[span.Name] = span
+	}
+
+	authorize, ok := spans["authorize"]
+	if !ok {
+		t.Fatalf("expected an authorize span, got %v", c.spans)
+	}
+	if hex.EncodeToString(authorize.ParentSpanId) != parentSpanID {
+		t.Fatalf("expected the authorize span to be a child of %s, got %x", parentSpanID, authorize.ParentSpanId)
+	}
+	if authorize.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Fatalf("expected the authorize span to be a server span, got %s", authorize.Kind)
+	}
+	attributes := map[string]string{}
+	for _, attribute := range authorize.Attributes {
+		switch value := attribute.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			attributes[attribute.Key] = value.StringValue
+		case *commonpb.AnyValue_BoolValue:
+			attributes[attribute.Key] = strconv.FormatBool(value.BoolValue)
+		}
+	}
+	if attributes["decision_id"] == "" || attributes["docker.operation"] != "containers/list" || attributes["ok"] != "true" {
+		t.Fatalf("expected decision_id, docker.operation and ok attributes, got %v", attributes)
+	}
+
+	tests := []struct {
+		name   string
+		parent string
+	}{
+		{name: "input", parent: "authorize"},
+		{name: "evaluation", parent: "authorize"},
+		{name: "storage", parent: "authorize"},
+		{name: "dns.a", parent: "evaluation"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			span, ok := spans[test.name]
+			if !ok {
+				t.Fatalf("expected a %s span", test.name)
+			}
+			if !bytes.Equal(span.ParentSpanId, spans[test.parent].SpanId) {
+				t.Fatalf("expected the %s span to be a child of the %s span", test.name, test.parent)
+			}
+			if span.StartTimeUnixNano < authorize.StartTimeUnixNano || span.EndTimeUnixNano > authorize.EndTimeUnixNano {
+				t.Fatalf("expected the %s span to be within the authorize span", test.name)
+			}
+		})
+	}
+}
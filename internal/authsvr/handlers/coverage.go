@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"golang.org/x/exp/slog"
+)
+
+// On GET, returns the lines of each policy file which have and have not been evaluated by requests to /authorize
+// since policies were loaded, when policy.coverage.enabled is set. On POST, discards the coverage collected so far.
+func coverageHandler(w http.ResponseWriter, r *http.Request) {
+	evaluator := internal.Evaluator.Load()
+	switch r.Method {
+	case http.MethodPost:
+		internal.ResetCoverage(evaluator.Revision())
+		w.Header().Add("content-type", "text/plain")
+		fmt.Fprintln(w, "OK")
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed (use GET, or POST to reset)")
+		return
+	}
+
+	j, err := json.MarshalIndent(internal.Coverage(evaluator), "", "  ")
+	if err != nil {
+		slog.Error("Unable to marshal coverage to JSON (likely a bug)", slog.Any("error", err))
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Unable to marshal coverage")
+		return
+	}
+	w.Header().Add("content-type", "application/json")
+	fmt.Fprintf(w, "%s\n", j)
+}
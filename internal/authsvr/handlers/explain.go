@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/redact"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/lineage"
+	"golang.org/x/exp/slog"
+)
+
+// The levels of detail available from /reflection/explain, as for the explain parameter of OPA's REST API
+var explainFilters = map[string]func([]*topdown.Event) []*topdown.Event{
+	"full":  lineage.Full,
+	"notes": lineage.Notes,
+	"fails": lineage.Fails,
+}
+
+type explainResponse struct {
+	Explain     string      `json:"explain"`
+	Revision    string      `json:"revision"`
+	Result      interface{} `json:"result,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Explanation []string    `json:"explanation"`
+}
+
+// Evaluates the policies with OPA's tracer enabled, and returns the explanation along with the result. The input is
+// constructed from the request exactly as for /authorize, unless the request has a content type of application/json,
+// in which case its body is used as the input (for example, as returned by /reflection/input). The level of detail
+// is set by the explain query parameter, which may be "full" (the default), "notes" or "fails".
+//
+// This never writes to storage or records decisions, so it does not affect subsequent evaluations.
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("explain")
+	if mode == "" {
+		mode = "full"
+	}
+	filter, ok := explainFilters[mode]
+	if !ok {
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "explain must be one of \"full\", \"notes\" or \"fails\"")
+		return
+	}
+
+	var input interface{}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type")); mediaType == "application/json" {
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&input); err != nil {
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unable to parse input: %s\n", err)
+			return
+		}
+	} else {
+		madeInput, err := internal.MakeInput(r)
+		if err != nil {
+			slog.Error("Unable to construct input (likely a bug)", slog.Any("error", err))
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Unable to construct input")
+			return
+		}
+		input = madeInput
+	}
+
+	evaluator := internal.Evaluator.Load()
+	tracer := topdown.NewBufferTracer()
+	resultSet, evalErr := evaluator.EvaluateQuery(r.Context(), rego.EvalInput(input), rego.EvalQueryTracer(tracer))
+
+	var explanation bytes.Buffer
+	topdown.PrettyTraceWithLocation(&explanation, filter(*tracer))
+
+	response := explainResponse{
+		Explain:     mode,
+		Revision:    evaluator.Revision(),
+		Explanation: []string{},
+	}
+	if explanation.Len() > 0 {
+		response.Explanation = strings.Split(strings.TrimSuffix(explanation.String(), "\n"), "\n")
+	}
+	status := http.StatusOK
+	if evalErr != nil {
+		response.Error = evalErr.Error()
+		status = http.StatusInternalServerError
+	} else {
+		redacted, _, _, err := redact.Redact(map[string]interface{}{"result": resultSet[0].Bindings})
+		if err != nil {
+			slog.Error("Unable to redact result (likely a bug)", slog.Any("error", err))
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Unable to redact result")
+			return
+		}
+		response.Result = redacted.(map[string]interface{})["result"]
+	}
+
+	j, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		slog.Error("Unable to marshal explanation to JSON (likely a bug)", slog.Any("error", err))
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Unable to marshal explanation")
+		return
+	}
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", j)
+}
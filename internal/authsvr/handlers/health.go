@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/listener"
+	"golang.org/x/exp/slog"
+)
+
+type healthCheck struct {
+	Ok      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+func HealthHandlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"healthz": ifHealthEnabled(healthzHandler),
+		"readyz":  ifHealthEnabled(readyzHandler),
+	}
+}
+
+func ifHealthEnabled(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.ConfigurationPointer.Load().Health.Enabled {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Always OK, as responding at all means the process is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, true, nil)
+}
+
+// OK only if we can make authorization decisions: policies are loaded (and, if health.require_latest_policies is set,
+// the most recent attempt to reload them succeeded), and every listener is accepting connections.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]healthCheck{
+		"policies_loaded": checkPoliciesLoaded(),
+		"latest_policies": checkLatestPolicies(config.ConfigurationPointer.Load().Health.RequireLatestPolicies),
+		"listeners":       checkListeners(),
+	}
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.Ok
+	}
+	writeHealth(w, ready, checks)
+}
+
+func checkPoliciesLoaded() healthCheck {
+	evaluator := internal.Evaluator.Load()
+	if evaluator == nil {
+		return healthCheck{Ok: false, Message: "no policies have been loaded"}
+	}
+	return healthCheck{Ok: true, Message: fmt.Sprintf("revision %s", evaluator.Revision())}
+}
+
+// Policies which failed to reload leave the previous ones in use, so this is only a failure if required is set
+func checkLatestPolicies(required bool) healthCheck {
+	load := internal.LastPolicyLoad.Load()
+	if load == nil {
+		return healthCheck{Ok: !required, Message: "policies have not been loaded"}
+	}
+	if load.Error != nil {
+		message := fmt.Sprintf("the most recent attempt to load policies, at %s, failed: %s", load.Time.Format("2006-01-02 15:04:05 MST"), load.Error)
+		if !required {
+			message += " (ignored, as health.require_latest_policies is not set)"
+		}
+		return healthCheck{Ok: !required, Message: message}
+	}
+	return healthCheck{Ok: true, Message: fmt.Sprintf("loaded at %s", load.Time.Format("2006-01-02 15:04:05 MST"))}
+}
+
+func checkListeners() healthCheck {
+	serving, starting := listener.ServerStatus()
+	if starting {
+		return healthCheck{Ok: false, Message: "still starting"}
+	}
+	accepting, stopped := make([]string, 0, len(serving)), make([]string, 0)
+	for name, ok := range serving {
+		if ok {
+			accepting = append(accepting, name)
+		} else {
+			stopped = append(stopped, name)
+		}
+	}
+	sort.Strings(accepting)
+	sort.Strings(stopped)
+	if len(stopped) > 0 {
+		return healthCheck{Ok: false, Message: fmt.Sprintf("not accepting connections: %s", strings.Join(stopped, ", "))}
+	}
+	return healthCheck{Ok: true, Message: fmt.Sprintf("accepting connections: %s", strings.Join(accepting, ", "))}
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, checks map[string]healthCheck) {
+	j, err := json.MarshalIndent(struct {
+		Ok     bool                   `json:"ok"`
+		Checks map[string]healthCheck `json:"checks,omitempty"`
+	}{
+		Ok:     ok,
+		Checks: checks,
+	}, "", "  ")
+	if err != nil {
+		slog.Error("Unable to marshal health to JSON (likely a bug)", slog.Any("error", err))
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Unable to marshal health")
+		return
+	}
+	w.Header().Add("content-type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "%s\n", j)
+}
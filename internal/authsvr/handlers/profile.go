@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// On GET, returns the expressions which have taken the most time across sampled evaluations (see policy.profiling).
+// The n query parameter sets how many expressions to return (0 for all of them; default policy.profiling.top_n), and
+// the sort query parameter sets how they are ranked (one of internal.PROFILE_SORT_CRITERIA; default total_time_ns).
+// On POST, discards the profile collected so far.
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		internal.ResetProfile(internal.Evaluator.Load().Revision())
+		w.Header().Add("content-type", "text/plain")
+		fmt.Fprintln(w, "OK")
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method not allowed (use GET, or POST to reset)")
+		return
+	}
+
+	n := config.ConfigurationPointer.Load().Policy.Profiling.TopN
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			w.Header().Add("content-type", "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "n must be a non-negative integer")
+			return
+		}
+		n = parsed
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = internal.PROFILE_SORT_CRITERIA[0]
+	}
+	if !slices.Contains(internal.PROFILE_SORT_CRITERIA, sortBy) {
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "sort must be one of %s\n", strings.Join(internal.PROFILE_SORT_CRITERIA, ", "))
+		return
+	}
+
+	j, err := json.MarshalIndent(internal.TopProfiledExpressions(n, sortBy), "", "  ")
+	if err != nil {
+		slog.Error("Unable to marshal profile to JSON (likely a bug)", slog.Any("error", err))
+		w.Header().Add("content-type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Unable to marshal profile")
+		return
+	}
+	w.Header().Add("content-type", "application/json")
+	fmt.Fprintf(w, "%s\n", j)
+}
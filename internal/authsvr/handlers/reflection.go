@@ -7,6 +7,7 @@ import (
 
 	"github.com/mjec/docker-socket-authorizer/config"
 	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/redact"
 	"golang.org/x/exp/slog"
 )
 
@@ -17,6 +18,9 @@ func ReflectionHandlers() map[string]http.HandlerFunc {
 		"meta-policy":           ifEnabled(metaPolicyHandler),
 		"configuration":         ifEnabled(configurationHandler),
 		"default-configuration": ifEnabled(defaultConfigurationHandler),
+		"explain":               ifEnabled(explainHandler),
+		"profile":               ifEnabled(profileHandler),
+		"coverage":              ifEnabled(coverageHandler),
 	}
 }
 
@@ -39,7 +43,15 @@ func inputHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Unable to construct input")
 		return
 	}
-	j, err := json.MarshalIndent(input, "", "  ")
+	redactedInput, err := redact.RedactInput(input)
+	if err != nil {
+		slog.Error("Unable to redact input (likely a bug)", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Header().Add("content-type", "text/plain")
+		fmt.Fprintln(w, "Unable to redact input")
+		return
+	}
+	j, err := json.MarshalIndent(redactedInput, "", "  ")
 	if err != nil {
 		slog.Error("Unable to marshal input to JSON (likely a bug)", slog.Any("error", err))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -7,7 +7,9 @@ import (
 
 	"github.com/mjec/docker-socket-authorizer/config"
 	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/decisionlog"
 	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/mjec/docker-socket-authorizer/internal/systemd"
 	"golang.org/x/exp/slog"
 )
 
@@ -37,6 +39,8 @@ func ifEnabledAndPost(isEnabled func(cfg *config.Configuration) bool, handler ht
 }
 
 func reloadConfiguration(w http.ResponseWriter, r *http.Request) {
+	defer systemd.NotifyReloading()()
+
 	cfg, err := config.LoadConfiguration()
 	if err != nil {
 		slog.Warn("Unable to reload config", slog.Any("error", err))
@@ -70,11 +74,13 @@ func reloadConfiguration(w http.ResponseWriter, r *http.Request) {
 		OldPolicyWatcher string `json:"old_policy_watcher"`
 		NewPolicyWatcher string `json:"new_policy_watcher"`
 		Logger           string `json:"logger"`
+		DecisionLog      string `json:"decision_log"`
 	}{
 		Configuration:    "Reloaded OK (NOTE: some configuration values require a restart to change)",
 		OldPolicyWatcher: "Did not attempt to stop",
 		NewPolicyWatcher: "Did not attempt to start",
 		Logger:           "Did not attempt to reopen",
+		DecisionLog:      "Did not attempt to reopen",
 	}
 
 	// We are always OK as soon as the ConfigurationPointer is updated
@@ -88,6 +94,14 @@ func reloadConfiguration(w http.ResponseWriter, r *http.Request) {
 		results.Logger = "Reopened OK"
 	}
 
+	// decisionlog.Configure is thread safe
+	if err := decisionlog.Configure(); err != nil {
+		results.DecisionLog = fmt.Sprintf("Unable to reopen decision log: %s", err)
+		slog.Error("Unable to reopen decision log", slog.Any("error", err))
+	} else {
+		results.DecisionLog = "Reopened OK"
+	}
+
 	// GlobalPolicyWatcher is an atomic pointer which we update with CAS, making this operation thread safe
 	originalPolicyWatcher := internal.GlobalPolicyWatcher.Load()
 	// If we have a policy watcher but our config is not to, that means it changed. We should shut down the watcher.
@@ -160,6 +174,14 @@ func reopenLogFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := decisionlog.Configure(); err != nil {
+		slog.Warn("Unable to reopen decision log", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Header().Add("content-type", "text/plain")
+		fmt.Fprintf(w, "Unable to reopen decision log: %s\n", err)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Header().Add("content-type", "text/plain")
 	fmt.Fprintln(w, "Reloaded OK")
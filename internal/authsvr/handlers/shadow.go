@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/jsonpath"
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+	"golang.org/x/exp/slog"
+)
+
+// The parts of the result we log when shadow policies disagree with the real ones
+var shadowComparisonPaths, _ = jsonpath.ParseAll([]string{"ok", "allows", "denies", "skips", "invalid_policies", "invalid_storage"})
+
+var shadowEvaluationsInFlight atomic.Int64 = atomic.Int64{}
+
+// Evaluates input against the shadow policies (if any) in the background, and logs and counts any disagreement with
+// bindings, the result of the real evaluation. The shadow evaluation never affects the response: it runs after the
+// real decision is made, on its own goroutine, within policy.shadow.timeout_milliseconds, and is skipped entirely if
+// policy.shadow.max_concurrent shadow evaluations are already running.
+// Builtins with non-deterministic results (e.g. dns.a) return what they returned during the real evaluation, so any
+// disagreement is due to the policies alone.
+func evaluateShadow(decisionID string, input interface{}, ndBuiltinCache builtins.NDBCache, bindings rego.Vars) {
+	evaluator := internal.ShadowEvaluator.Load()
+	if evaluator == nil {
+		return
+	}
+
+	cfg := config.ConfigurationPointer.Load()
+	if shadowEvaluationsInFlight.Add(1) > int64(cfg.Policy.Shadow.MaxConcurrent) {
+		shadowEvaluationsInFlight.Add(-1)
+		o11y.Metrics.ShadowEvaluations.WithLabelValues("skipped").Inc()
+		return
+	}
+
+	// The real evaluation's cache is still referenced by its decision, and the shadow evaluation may add to it
+	shadowNDBuiltinCache := make(builtins.NDBCache, len(ndBuiltinCache))
+	for builtin, results := range ndBuiltinCache {
+		shadowNDBuiltinCache[builtin] = results.Copy()
+	}
+	timeout := time.Duration(cfg.Policy.Shadow.TimeoutMilliseconds) * time.Millisecond
+	logger := slog.Default().With(slog.String("decision_id", decisionID), slog.Bool("shadow", true), slog.String("shadow_revision", evaluator.Revision()))
+
+	go func() {
+		defer shadowEvaluationsInFlight.Add(-1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		shadowBindings, err := evaluateShadowQuery(ctx, evaluator, input, shadowNDBuiltinCache, logger)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			o11y.Metrics.ShadowEvaluations.WithLabelValues("timeout").Inc()
+			logger.Warn("Shadow evaluation timed out", slog.Int("timeout_milliseconds", cfg.Policy.Shadow.TimeoutMilliseconds))
+			return
+		}
+		if err != nil {
+			o11y.Metrics.ShadowEvaluations.WithLabelValues("error").Inc()
+			logger.Error("Error evaluating shadow policies", slog.Any("error", err))
+			return
+		}
+
+		if shadowBindings["ok"].(bool) == bindings["ok"].(bool) {
+			o11y.Metrics.ShadowEvaluations.WithLabelValues("agree").Inc()
+			return
+		}
+
+		o11y.Metrics.ShadowEvaluations.WithLabelValues("disagree").Inc()
+		realResult, err := fieldsToLog("result", bindings, shadowComparisonPaths)
+		if err != nil {
+			logger.Error("Unable to redact result for logging; not logging it", slog.Any("error", err))
+			realResult = nil
+		}
+		shadowResult, err := fieldsToLog("result", shadowBindings, shadowComparisonPaths)
+		if err != nil {
+			logger.Error("Unable to redact shadow result for logging; not logging it", slog.Any("error", err))
+			shadowResult = nil
+		}
+		logger.Warn("Shadow policies disagree with the real decision", slog.Any("result", realResult), slog.Any("shadow_result", shadowResult))
+	}()
+}
+
+// Evaluates the query against the shadow policies, enforcing storage quotas and writing to the shadow policies' own
+// storage exactly as for a real decision, so stateful shadow policies behave as they would if they were live.
+func evaluateShadowQuery(ctx context.Context, evaluator *internal.RegoEvaluator, input interface{}, ndBuiltinCache builtins.NDBCache, logger *slog.Logger) (rego.Vars, error) {
+	resultSet, err := evaluator.EvaluateQuery(ctx, rego.EvalInput(input), rego.EvalNDBuiltinCache(ndBuiltinCache))
+	if err != nil {
+		return nil, err
+	}
+	if len(resultSet) == 0 {
+		return nil, errors.New("query produced no results")
+	}
+	bindings := resultSet[0].Bindings
+	if err := internal.EnforceStorageQuotas(evaluator, bindings, logger); err != nil {
+		return nil, err
+	}
+	if err := evaluator.WriteToStorage(ctx, bindings["to_store"].(map[string]interface{})); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package authsvr
+
+import (
+	"net"
+	"syscall"
+)
+
+func getPeerCredentials(c *net.UnixConn) (peerCredentials, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, err
+	}
+	var ucred *syscall.Ucred
+	var ucredErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, ucredErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return peerCredentials{}, err
+	}
+	if ucredErr != nil {
+		return peerCredentials{}, ucredErr
+	}
+	return peerCredentials{uid: int(ucred.Uid), gid: int(ucred.Gid)}, nil
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package authsvr
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithPeerCredentials(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "admin.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		conn net.Conn
+	}{
+		{name: "unix", conn: server},
+		// A unix listener using TLS accepts *tls.Conn, which must be unwrapped to get the peer credentials
+		{name: "unix with tls", conn: tls.Server(server, &tls.Config{})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			credentials, ok := withPeerCredentials(context.Background(), test.conn).Value(peerCredentialsKey).(peerCredentials)
+			if !ok {
+				t.Fatal("expected peer credentials in context")
+			}
+			if credentials.uid != os.Getuid() || credentials.gid != os.Getgid() {
+				t.Fatalf("expected uid %d and gid %d, got %+v", os.Getuid(), os.Getgid(), credentials)
+			}
+		})
+	}
+}
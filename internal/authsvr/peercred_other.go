@@ -0,0 +1,13 @@
+//go:build !linux
+
+package authsvr
+
+import (
+	"errors"
+	"net"
+)
+
+// Only implemented for Linux (SO_PEERCRED), so admin.authentication.unix_users and unix_groups never match elsewhere
+func getPeerCredentials(_ *net.UnixConn) (peerCredentials, error) {
+	return peerCredentials{}, errors.New("unix socket peer credentials are only supported on linux")
+}
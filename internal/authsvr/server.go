@@ -1,47 +1,82 @@
 package authsvr
 
 import (
-	"net"
 	"net/http"
 
 	"github.com/mjec/docker-socket-authorizer/config"
 	"github.com/mjec/docker-socket-authorizer/internal/authsvr/handlers"
-	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"github.com/mjec/docker-socket-authorizer/internal/listener"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/exp/slog"
 )
 
 func InitializeAuthServer(cfg *config.Configuration) error {
 	authorizerMux := http.NewServeMux()
 
-	for path, handler := range handlers.ReflectionHandlers() {
-		authorizerMux.HandleFunc("/reflection/"+path, handler)
-	}
-
-	for path, handler := range handlers.ReloadHandlers() {
-		authorizerMux.HandleFunc("/reload/"+path, handler)
+	// For compatibility with configurations from before there was an admin listener
+	if cfg.Authorizer.IncludesAdmin {
+		addAdminHandlers(authorizerMux)
 	}
 
 	authorizerMux.HandleFunc("/authorize", handlers.Authorize)
+	addHealthHandlers(authorizerMux)
 
 	if cfg.Authorizer.IncludesMetrics {
 		authorizerMux.Handle(cfg.Metrics.Path, ifMetricsEnabled(promhttp.Handler()))
 	}
 
-	listener, err := net.Listen(cfg.Authorizer.Listener.Type, cfg.Authorizer.Listener.Address)
-	if err != nil {
+	authorizerTls := func(cfg *config.Configuration) config.ListenerTLS { return cfg.Authorizer.Listener.Tls }
+	if err := serve("authorization server", cfg.Authorizer.Listener.Type, cfg.Authorizer.Listener.Address, authorizerTls, authorizerMux); err != nil {
 		return err
 	}
 
-	defer shutdown.OnShutdown("auth server", func() {
-		listener.Close()
-	})
+	if cfg.Admin.Listener.Type != "" && cfg.Admin.Listener.Type != "none" {
+		adminMux := http.NewServeMux()
+		addAdminHandlers(adminMux)
+		addHealthHandlers(adminMux)
+		if cfg.Admin.IncludesMetrics {
+			adminMux.Handle(cfg.Metrics.Path, ifMetricsEnabled(promhttp.Handler()))
+		}
+		adminTls := func(cfg *config.Configuration) config.ListenerTLS { return cfg.Admin.Listener.Tls }
+		if err := serve("admin server", cfg.Admin.Listener.Type, cfg.Admin.Listener.Address, adminTls, adminMux); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Adds the handlers for /reflection/ and /reload/ endpoints, which are served by the admin listener and require
+// authentication (see requireAdmin)
+func addAdminHandlers(mux *http.ServeMux) {
+	for path, handler := range handlers.ReflectionHandlers() {
+		mux.HandleFunc("/reflection/"+path, requireAdmin(handler))
+	}
 
-	go func() {
-		shutdownErr := http.Serve(listener, authorizerMux)
-		_ = shutdown.Shutdown("authorization server error", slog.LevelError, slog.With(slog.Any("error", shutdownErr)))
-	}()
+	for path, handler := range handlers.ReloadHandlers() {
+		mux.HandleFunc("/reload/"+path, requireAdmin(handler))
+	}
+}
 
+// Adds the handlers for /healthz and /readyz, which are served by the authorizer and admin listeners without
+// authentication, so that they can be used as probes
+func addHealthHandlers(mux *http.ServeMux) {
+	for path, handler := range handlers.HealthHandlers() {
+		mux.HandleFunc("/"+path, handler)
+	}
+}
+
+// Listens on address (see listener.Listen) and serves handler in the background until shutdown (see listener.Serve);
+// name identifies the server in logs
+func serve(name string, listenerType string, address string, tlsSettings func(cfg *config.Configuration) config.ListenerTLS, handler http.Handler) error {
+	serverListener, err := listener.Listen(listenerType, address, tlsSettings)
+	if err != nil {
+		return err
+	}
+
+	listener.Serve(name, serverListener, &http.Server{
+		Handler:     handler,
+		ConnContext: withPeerCredentials,
+	})
 	return nil
 }
 
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Returns the functions we provide to policies, as options to rego.New. Add new functions here using builtin1 (or a
+// similar helper), so they are instrumented.
+func customBuiltins() []func(*rego.Rego) {
+	return []func(*rego.Rego){
+		builtin1(
+			&rego.Function{
+				Name:             "dns.a",
+				Decl:             types.NewFunction(types.Args(types.S), types.NewArray(make([]types.Type, 0), types.S)),
+				Memoize:          true,
+				Nondeterministic: true,
+			},
+			dnsA,
+		),
+		builtin1(
+			&rego.Function{
+				Name:             "dns.ptr",
+				Decl:             types.NewFunction(types.Args(types.S), types.NewArray(make([]types.Type, 0), types.S)),
+				Memoize:          true,
+				Nondeterministic: true,
+			},
+			dnsPtr,
+		),
+	}
+}
+
+// Registers a function of one argument, instrumented with call, error and latency metrics.
+func builtin1(function *rego.Function, implementation rego.Builtin1) func(*rego.Rego) {
+	return rego.Function1(function, func(ctx rego.BuiltinContext, a *ast.Term) (*ast.Term, error) {
+		return instrumentBuiltin(ctx.Context, function.Name, func() (*ast.Term, error) {
+			return implementation(ctx, a)
+		})
+	})
+}
+
+type liveEvaluationKeyT struct{}
+
+var liveEvaluationKey liveEvaluationKeyT = liveEvaluationKeyT{}
+
+// Marks ctx as the context of an evaluation which authorizes a real request, so that builtins called during it are
+// recorded in metrics. Calls made by other evaluations (of shadow policies, by /reflection/explain or by replay) are
+// only traced, so they don't skew the metrics.
+func LiveEvaluationContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, liveEvaluationKey, true)
+}
+
+func instrumentBuiltin(ctx context.Context, name string, call func() (*ast.Term, error)) (*ast.Term, error) {
+	// ctx is the context the query is being evaluated in, so this span is a child of the evaluation's span
+	_, span := o11y.Tracer.Start(ctx, name)
+	defer span.End()
+	live, _ := ctx.Value(liveEvaluationKey).(bool)
+
+	start := time.Now()
+	result, err := call()
+	if live {
+		o11y.Metrics.BuiltinTimer.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		o11y.Metrics.BuiltinCalls.WithLabelValues(name).Inc()
+		if err != nil {
+			o11y.Metrics.BuiltinErrors.WithLabelValues(name).Inc()
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "builtin returned an error")
+	}
+	return result, err
+}
+
+func dnsA(_ rego.BuiltinContext, nameArgument *ast.Term) (*ast.Term, error) {
+	var name string
+	if err := ast.As(nameArgument.Value, &name); err != nil {
+		return nil, fmt.Errorf("dns.a: invalid argument (string required): %s", err)
+	}
+
+	forwardIps, err := net.LookupHost(name)
+	if err != nil {
+		return nil, fmt.Errorf("dns.a: error: %s", err)
+	}
+
+	ipTerms := make([]*ast.Term, len(forwardIps))
+	for i, name := range forwardIps {
+		ipTerms[i] = ast.StringTerm(name)
+	}
+
+	return ast.ArrayTerm(ipTerms...), nil
+}
+
+func dnsPtr(_ rego.BuiltinContext, ipArgument *ast.Term) (*ast.Term, error) {
+	var ip string
+	if err := ast.As(ipArgument.Value, &ip); err != nil {
+		return nil, fmt.Errorf("dns.ptr: invalid argument (string required): %s", err)
+	}
+
+	if ip == "" || ip == "@" {
+		return ast.ArrayTerm(), nil
+	}
+
+	names, err := net.LookupAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("dns.ptr: invalid argument (IP address required): %s", err)
+	}
+
+	nameTerms := make([]*ast.Term, len(names))
+	for i, name := range names {
+		nameTerms[i] = ast.StringTerm(name)
+	}
+
+	return ast.ArrayTerm(nameTerms...), nil
+}
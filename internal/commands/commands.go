@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A subcommand, which receives the command line arguments after its name and returns the process exit code.
+type Command struct {
+	Description string
+	Run         func(args []string) int
+}
+
+var Commands = map[string]Command{
+	"coverage": {
+		Description: "Report which lines of the live policies have been evaluated, from /reflection/coverage",
+		Run:         Coverage,
+	},
+	"replay": {
+		Description: "Report which recorded decisions would change under a candidate set of policies",
+		Run:         Replay,
+	},
+	"verify-log": {
+		Description: "Verify the hash chain and checkpoint signatures of decision log files",
+		Run:         VerifyLog,
+	},
+}
+
+// Writes a summary of every available subcommand to w.
+func PrintUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command] [arguments]\n\nWith no command (or any arguments other than a command), runs the authorizer. Available commands:\n\n", os.Args[0])
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, Commands[name].Description)
+	}
+	fmt.Fprintf(w, "\nRun %s <command> -h for help with a command.\n", os.Args[0])
+}
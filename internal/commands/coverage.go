@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/open-policy-agent/opa/cover"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+func Coverage(args []string) int {
+	flags := flag.NewFlagSet("coverage", flag.ContinueOnError)
+	socket := flags.String("socket", "", "Connect to this unix socket to fetch the report, rather than the host in the URL (e.g. the admin.listener address)")
+	tokenFile := flags.String("token-file", "", "Send the token in this file as a bearer token, if admin.authentication requires one")
+	showSource := flags.Bool("source", false, "Also print the source of lines which were not covered, if the policy files can be read from the current directory")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s coverage [-socket admin.sock] [-token-file token] [-source] http://host/reflection/coverage | coverage.json\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Renders a report of which lines of the live policies have been evaluated, from /reflection/coverage (which requires policy.coverage.enabled) or a file previously saved from it. Use - to read from stdin.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	report, err := readCoverageReport(flags.Arg(0), *socket, *tokenFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read coverage report: %s\n", err)
+		return 2
+	}
+
+	files := maps.Keys(report.Files)
+	slices.Sort(files)
+	for _, file := range files {
+		fileReport := report.Files[file]
+		fmt.Printf("%s: %s\n", file, formatCoverage(fileReport.CoveredLines, fileReport.NotCoveredLines))
+		if len(fileReport.NotCovered) == 0 {
+			continue
+		}
+		fmt.Printf("  not covered: %s\n", formatRanges(fileReport.NotCovered))
+		if *showSource {
+			printUncoveredSource(file, fileReport)
+		}
+	}
+
+	fmt.Printf("\n%s covered by %d evaluations since %s, for policy revision %s\n",
+		formatCoverage(report.CoveredLines, report.NotCoveredLines), report.Evaluations,
+		report.Since.Format("2006-01-02 15:04:05 MST"), report.Revision)
+	if report.Evaluations == 0 {
+		fmt.Println("WARNING: no evaluations have been recorded; check that policy.coverage.enabled is set")
+	}
+	return 0
+}
+
+// Reads a report from source, which may be an http(s) URL, a filename, or - for stdin. If socket is set, requests
+// to a URL are sent over that unix socket instead, and if tokenFile is set they include its contents as a bearer token.
+func readCoverageReport(source string, socket string, tokenFile string) (*internal.CoverageReport, error) {
+	var reader io.Reader
+	switch {
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		client := &http.Client{}
+		if socket != "" {
+			client.Transport = &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			}
+		}
+		request, err := http.NewRequest(http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		if tokenFile != "" {
+			token, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return nil, err
+			}
+			request.Header.Set("authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s (is reflection.enabled set, and are you authenticated?)", source, response.Status)
+		}
+		reader = response.Body
+	case source == "-":
+		reader = os.Stdin
+	default:
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	report := &internal.CoverageReport{}
+	if err := json.NewDecoder(reader).Decode(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func formatCoverage(covered int, notCovered int) string {
+	percentage := 0.0
+	if covered+notCovered > 0 {
+		percentage = 100 * float64(covered) / float64(covered+notCovered)
+	}
+	return fmt.Sprintf("%.2f%% (%d of %d lines)", percentage, covered, covered+notCovered)
+}
+
+func formatRanges(ranges []cover.Range) string {
+	formatted := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Start.Row == r.End.Row {
+			formatted = append(formatted, fmt.Sprint(r.Start.Row))
+		} else {
+			formatted = append(formatted, fmt.Sprintf("%d-%d", r.Start.Row, r.End.Row))
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func printUncoveredSource(file string, fileReport *cover.FileReport) {
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Printf("  (unable to read source: %s)\n", err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for row := 1; scanner.Scan(); row++ {
+		if fileReport.IsNotCovered(row) {
+			fmt.Printf("  %5d | %s\n", row, scanner.Text())
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal"
+	"github.com/mjec/docker-socket-authorizer/internal/decisionlog"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown/builtins"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// A list of strings that can be set by repeating a flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// A record to replay: either a decision log record or a captured /reflection/input dump (in which case only Input is
+// set, from the whole document)
+type replayRecord struct {
+	DecisionID     string                 `json:"decision_id"`
+	Input          interface{}            `json:"input"`
+	Result         map[string]interface{} `json:"result"`
+	NDBuiltinCache json.RawMessage        `json:"nd_builtin_cache"`
+	Masked         []string               `json:"masked"`
+	Erased         []string               `json:"erased"`
+}
+
+// Returns the paths (as JSON pointers) of input values which were masked, hashed or dropped before the record was
+// logged, and so can't be replayed as they were originally evaluated.
+func (r replayRecord) redactedInputs() []string {
+	var redacted []string
+	for _, path := range append(append([]string{}, r.Masked...), r.Erased...) {
+		if strings.HasPrefix(path, "/input/") {
+			redacted = append(redacted, path)
+		}
+	}
+	return redacted
+}
+
+// The parts of an evaluation result we compare
+type outcome struct {
+	ok       bool
+	policies map[string]string // policy name to "result: message"
+}
+
+func Replay(args []string) int {
+	var candidateDirectories, baselineDirectories stringList
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Var(&candidateDirectories, "policies", "Directory of candidate policies to evaluate records against (may be repeated; required)")
+	flags.Var(&baselineDirectories, "baseline", "Directory of policies to compare against for records without a recorded result (may be repeated; defaults to policy.directories from the configuration)")
+	verbose := flags.Bool("v", false, "Also report records whose decision did not change")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay -policies candidate/ [-baseline current/] records.json [...]\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Evaluates recorded decisions (from the decision log) or inputs (from /reflection/input) against a candidate set of policies, and reports every decision that would change. Use - to read records from stdin.")
+		fmt.Fprintln(flags.Output(), "Exits with status 1 if any decision would change.")
+		fmt.Fprintln(flags.Output())
+		fmt.Fprintln(flags.Output(), "Replays are approximate. Every record is evaluated against empty storage, so policies that depend on data stored by earlier requests may decide differently than they would have. Inputs are replayed as they were logged, after redaction, so policies that read masked, hashed or dropped values (such as authorization headers) may also decide differently; such records are marked in the report and counted.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(candidateDirectories) == 0 || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	cfg := loadConfiguration()
+	if len(baselineDirectories) == 0 {
+		baselineDirectories = cfg.Policy.Directories
+	}
+
+	candidate, err := internal.NewEvaluator(rego.Load(candidateDirectories, nil))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load candidate policies: %s\n", err)
+		return 2
+	}
+	// Only loaded if we need it, i.e. for a record with no recorded result
+	var baseline *internal.RegoEvaluator = nil
+
+	var allowToDeny, denyToAllow, unchanged, failed, redacted int
+	for _, filename := range flags.Args() {
+		err := readRecords(filename, func(name string, record replayRecord) {
+			ndBuiltinCache := builtins.NDBCache{}
+			if len(record.NDBuiltinCache) > 0 {
+				if err := json.Unmarshal(record.NDBuiltinCache, &ndBuiltinCache); err != nil {
+					fmt.Printf("%s: ERROR: unable to read recorded builtin results: %s\n", name, err)
+					failed++
+					return
+				}
+			}
+
+			before, hasRecordedOutcome := outcomeFromBindings(record.Result)
+			if !hasRecordedOutcome {
+				if baseline == nil {
+					if baseline, err = internal.NewEvaluator(rego.Load(baselineDirectories, nil)); err != nil {
+						fmt.Printf("%s: ERROR: no recorded result, and unable to load baseline policies: %s\n", name, err)
+						failed++
+						return
+					}
+				}
+				if before, err = evaluateOutcome(baseline, record.Input, ndBuiltinCache); err != nil {
+					fmt.Printf("%s: ERROR: unable to evaluate baseline: %s\n", name, err)
+					failed++
+					return
+				}
+			}
+
+			after, err := evaluateOutcome(candidate, record.Input, ndBuiltinCache)
+			if err != nil {
+				fmt.Printf("%s: ERROR: unable to evaluate candidate: %s\n", name, err)
+				failed++
+				return
+			}
+
+			redactedInputs := record.redactedInputs()
+			if len(redactedInputs) > 0 {
+				redacted++
+			}
+
+			switch {
+			case before.ok && !after.ok:
+				allowToDeny++
+				fmt.Printf("%s: allow -> deny\n", name)
+			case !before.ok && after.ok:
+				denyToAllow++
+				fmt.Printf("%s: deny -> allow\n", name)
+			default:
+				unchanged++
+				if !*verbose {
+					return
+				}
+				fmt.Printf("%s: unchanged (%s)\n", name, decisionName(after.ok))
+			}
+			if len(redactedInputs) > 0 {
+				fmt.Printf("    WARNING: input was redacted before it was logged, so this may not reflect real traffic: %s\n", strings.Join(redactedInputs, ", "))
+			}
+			printPolicyComparison(before, after)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read records from %s: %s\n", filename, err)
+			return 2
+		}
+	}
+
+	fmt.Printf("\n%d allow -> deny, %d deny -> allow, %d unchanged, %d errors\n", allowToDeny, denyToAllow, unchanged, failed)
+	if redacted > 0 {
+		fmt.Printf("WARNING: %d records had redacted inputs, which were replayed as logged rather than as originally evaluated\n", redacted)
+	}
+	if failed > 0 {
+		return 2
+	}
+	if allowToDeny+denyToAllow > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Loads the configuration (or defaults) without configuring logging, as commands write to stdout and stderr.
+func loadConfiguration() *config.Configuration {
+	config.InitializeConfiguration()
+	cfg, err := config.LoadConfiguration()
+	if err != nil {
+		cfg = config.DefaultConfiguration()
+	}
+	// Print statements in policies would be interleaved with our output
+	cfg.Policy.PrintTo = "none"
+	config.ConfigurationPointer.Store(cfg)
+	return cfg
+}
+
+// Calls handle for every record in filename (or stdin, if filename is "-"), which may be a decision log (one JSON
+// record per line, gzipped if it is a compressed rotated file) or one or more concatenated JSON documents each
+// containing an input.
+func readRecords(filename string, handle func(name string, record replayRecord)) error {
+	var reader io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := decisionlog.OpenFile(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	decoder := json.NewDecoder(reader)
+	for index := 1; ; index++ {
+		var document map[string]interface{}
+		if err := decoder.Decode(&document); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var record replayRecord
+		if _, isDecision := document["decision_id"]; isDecision {
+			// Round trip so we get the recorded result and builtin cache in the forms we want
+			serialized, err := json.Marshal(document)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(serialized, &record); err != nil {
+				return err
+			}
+		} else if document["type"] == decisionlog.CHECKPOINT_TYPE {
+			continue
+		} else {
+			record.Input = document
+		}
+
+		name := fmt.Sprintf("%s#%d", filename, index)
+		if record.DecisionID != "" {
+			name = fmt.Sprintf("%s (decision %s)", name, record.DecisionID)
+		}
+		if record.Input == nil {
+			fmt.Printf("%s: skipped (no input recorded)\n", name)
+			continue
+		}
+		handle(name, record)
+	}
+}
+
+func evaluateOutcome(evaluator *internal.RegoEvaluator, input interface{}, ndBuiltinCache builtins.NDBCache) (outcome, error) {
+	resultSet, err := evaluator.EvaluateQuery(context.Background(), rego.EvalInput(input), rego.EvalNDBuiltinCache(ndBuiltinCache))
+	if err != nil {
+		return outcome{}, err
+	}
+	if len(resultSet) == 0 {
+		return outcome{}, fmt.Errorf("query produced no results")
+	}
+	result, ok := outcomeFromBindings(resultSet[0].Bindings)
+	if !ok {
+		return outcome{}, fmt.Errorf("query did not produce an ok output (likely a bug)")
+	}
+	return result, nil
+}
+
+// Extracts the outcome from the bindings produced by the query, which may have been read back from the decision log.
+// Returns false if there is no ok output.
+func outcomeFromBindings(bindings map[string]interface{}) (outcome, bool) {
+	ok, hasOk := bindings["ok"].(bool)
+	if !hasOk {
+		return outcome{}, false
+	}
+	result := outcome{ok: ok, policies: map[string]string{}}
+	for binding, policyResult := range map[string]string{"allows": "allow", "denies": "deny", "skips": "skip"} {
+		messages, _ := bindings[binding].(map[string]interface{})
+		for policy, message := range messages {
+			result.policies[policy] = fmt.Sprintf("%s: %v", policyResult, message)
+		}
+	}
+	invalidPolicies, _ := bindings["invalid_policies"].([]interface{})
+	for _, policy := range invalidPolicies {
+		result.policies[fmt.Sprint(policy)] = "invalid"
+	}
+	return result, true
+}
+
+func printPolicyComparison(before, after outcome) {
+	policies := maps.Keys(before.policies)
+	for policy := range after.policies {
+		if _, ok := before.policies[policy]; !ok {
+			policies = append(policies, policy)
+		}
+	}
+	slices.Sort(policies)
+	for _, policy := range policies {
+		beforeResult, afterResult := before.policies[policy], after.policies[policy]
+		if beforeResult == "" {
+			beforeResult = "(not present)"
+		}
+		if afterResult == "" {
+			afterResult = "(not present)"
+		}
+		marker := " "
+		if beforeResult != afterResult {
+			marker = "*"
+		}
+		fmt.Printf("  %s %s\n      before: %s\n      after:  %s\n", marker, policy, beforeResult, afterResult)
+	}
+}
+
+func decisionName(ok bool) string {
+	if ok {
+		return "allow"
+	}
+	return "deny"
+}
@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mjec/docker-socket-authorizer/internal/decisionlog"
+)
+
+func VerifyLog(args []string) int {
+	flags := flag.NewFlagSet("verify-log", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "PEM file containing the public (or private) key that signed checkpoints; if not set, checkpoint signatures are not verified")
+	firstHash := flags.String("first-hash", "", "the expected previous_hash of the first record: \"genesis\" if the first file starts at the beginning of the log, or the last hash reported when verifying the files before it; if not set, records removed from the start of the log cannot be detected")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify-log [-key key.pem] [-first-hash hash] decisions.log [newer-decisions.log ...]\n\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Walks the hash chain of one or more decision log files, in order from oldest to newest, and reports the first break in the chain.")
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var publicKey ed25519.PublicKey = nil
+	if *keyFile != "" {
+		key, err := decisionlog.LoadPublicKey(*keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load key: %s\n", err)
+			return 2
+		}
+		publicKey = key
+	}
+
+	if *firstHash == "genesis" {
+		*firstHash = decisionlog.GENESIS_HASH
+	}
+
+	result, err := decisionlog.Verify(flags.Args(), publicKey, *firstHash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to verify decision log: %s\n", err)
+		return 2
+	}
+
+	if result.Break != "" {
+		fmt.Printf("BROKEN at %s:%d: %s\n", result.BreakFile, result.BreakLine, result.Break)
+		fmt.Printf("%d records and %d checkpoints were read before the break; the record before the break may have been modified, or records may have been inserted or removed\n", result.Records, result.Checkpoints)
+		return 1
+	}
+
+	fmt.Printf("OK: %d records and %d checkpoints\n", result.Records, result.Checkpoints)
+	fmt.Printf("Last hash: %s\n", result.LastHash)
+	if *firstHash == "" {
+		fmt.Println("WARNING: no -first-hash was provided, so records removed from the start of the log would not be detected")
+	}
+	if publicKey == nil {
+		fmt.Println("WARNING: no key was provided, so checkpoint signatures were not verified; the chain alone does not prove records were not rewritten")
+	} else {
+		fmt.Printf("%d checkpoint signatures verified; %d records after the last verified checkpoint are not covered by a signature\n", result.VerifiedCheckpoints, result.RecordsAfterCheckpoint)
+	}
+	return 0
+}
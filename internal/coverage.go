@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/cover"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+type CoverageReport struct {
+	Revision    string    `json:"revision"`
+	Since       time.Time `json:"since"`
+	Evaluations int       `json:"evaluations"`
+	cover.Report
+}
+
+// Records the lines hit during a single evaluation, in the same way as OPA's cover.Cover. Not safe for concurrent use,
+// so each evaluation gets its own; they are merged into policyCoverage by RecordCoverage.
+type CoverageTracer struct {
+	hits map[string]map[int]struct{}
+}
+
+func (c *CoverageTracer) Enabled() bool {
+	return true
+}
+
+func (c *CoverageTracer) Config() topdown.TraceConfig {
+	return topdown.TraceConfig{PlugLocalVars: false}
+}
+
+func (c *CoverageTracer) TraceEvent(event topdown.Event) {
+	switch event.Op {
+	case topdown.ExitOp:
+		if rule, ok := event.Node.(*ast.Rule); ok {
+			c.hit(rule.Head.Location)
+		}
+	case topdown.EvalOp:
+		if expr, ok := event.Node.(*ast.Expr); ok && expr != nil {
+			c.hit(expr.Location)
+		}
+	}
+}
+
+func (c *CoverageTracer) hit(location *ast.Location) {
+	if location == nil || location.File == "" {
+		return
+	}
+	rows, ok := c.hits[location.File]
+	if !ok {
+		rows = map[int]struct{}{}
+		c.hits[location.File] = rows
+	}
+	rows[location.Row] = struct{}{}
+}
+
+// Accumulated across evaluations by the current Evaluator; reset whenever policies are loaded
+var policyCoverage = struct {
+	mutex       *sync.Mutex
+	revision    string
+	since       time.Time
+	evaluations int
+	hits        map[string]map[int]struct{}
+}{
+	mutex: &sync.Mutex{},
+	since: time.Now(),
+	hits:  map[string]map[int]struct{}{},
+}
+
+// Returns a new tracer if coverage is enabled by policy.coverage.enabled, or nil if not. A non-nil tracer should be
+// passed to EvaluateQuery with rego.EvalQueryTracer, then to RecordCoverage.
+func CoverageTracerIfEnabled() *CoverageTracer {
+	if !config.ConfigurationPointer.Load().Policy.Coverage.Enabled {
+		return nil
+	}
+	return &CoverageTracer{hits: map[string]map[int]struct{}{}}
+}
+
+// Adds the lines hit during an evaluation by evaluator to the accumulated coverage. As for RecordProfile, evaluations
+// by an evaluator which is no longer in use are discarded.
+func RecordCoverage(evaluator *RegoEvaluator, tracer *CoverageTracer) {
+	if !evaluator.reportsMetrics() || evaluator.isStale() {
+		return
+	}
+
+	policyCoverage.mutex.Lock()
+	defer policyCoverage.mutex.Unlock()
+	if policyCoverage.revision != evaluator.revision {
+		return
+	}
+	policyCoverage.evaluations++
+	for file, rows := range tracer.hits {
+		accumulated, ok := policyCoverage.hits[file]
+		if !ok {
+			accumulated = map[int]struct{}{}
+			policyCoverage.hits[file] = accumulated
+		}
+		for row := range rows {
+			accumulated[row] = struct{}{}
+		}
+	}
+}
+
+// Discards the accumulated coverage, and starts again for the policies with the given revision.
+func ResetCoverage(revision string) {
+	policyCoverage.mutex.Lock()
+	defer policyCoverage.mutex.Unlock()
+	policyCoverage.revision = revision
+	policyCoverage.since = time.Now()
+	policyCoverage.evaluations = 0
+	policyCoverage.hits = map[string]map[int]struct{}{}
+}
+
+// Returns the covered and uncovered lines of each policy file loaded by evaluator, accumulated since policies were
+// loaded (or coverage was last reset). The meta-policy, query and tests are not included.
+func Coverage(evaluator *RegoEvaluator) CoverageReport {
+	modules := map[string]*ast.Module{}
+	for file, module := range evaluator.authorizer.Modules() {
+		if file == "docker_socket_meta_policy" {
+			continue
+		}
+		// Tests are never evaluated by real requests, so including them would only make coverage look worse
+		withoutTests := *module
+		withoutTests.Rules = make([]*ast.Rule, 0, len(module.Rules))
+		for _, rule := range module.Rules {
+			if !strings.HasPrefix(rule.Head.Name.String(), "test_") {
+				withoutTests.Rules = append(withoutTests.Rules, rule)
+			}
+		}
+		modules[file] = &withoutTests
+	}
+
+	// OPA's cover.Cover works out which lines could have been covered, so we replay our hits into one to get its report
+	tracer := cover.New()
+	policyCoverage.mutex.Lock()
+	report := CoverageReport{
+		Revision:    policyCoverage.revision,
+		Since:       policyCoverage.since,
+		Evaluations: policyCoverage.evaluations,
+	}
+	for file, rows := range policyCoverage.hits {
+		if _, ok := modules[file]; !ok {
+			continue
+		}
+		for row := range rows {
+			tracer.TraceEvent(topdown.Event{Op: topdown.EvalOp, Node: &ast.Expr{Location: &ast.Location{File: file, Row: row}}})
+		}
+	}
+	policyCoverage.mutex.Unlock()
+
+	report.Report = tracer.Report(modules)
+	return report
+}
@@ -0,0 +1,293 @@
+package decisionlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+)
+
+// The previous_hash of the very first record in a chain
+var GENESIS_HASH = strings.Repeat("0", sha256.Size*2)
+
+const CHECKPOINT_TYPE = "checkpoint"
+
+// A signed record of the head of the hash chain. Checkpoints are part of the chain themselves, so they are hashed
+// into the previous_hash of the following record. The signature is over the checkpoint serialized as JSON without
+// the signature field.
+type Checkpoint struct {
+	Type         string            `json:"type"`
+	Labels       map[string]string `json:"labels"`
+	Timestamp    time.Time         `json:"timestamp"`
+	PreviousHash string            `json:"previous_hash"`
+	PublicKey    string            `json:"public_key"`
+	Signature    string            `json:"signature,omitempty"`
+}
+
+// The state of the hash chain. Not thread safe; only accessed with decisionLogSettings.mutex held.
+type hashChain struct {
+	head                   string
+	recordsSinceCheckpoint int
+	checkpointInterval     int
+	key                    ed25519.PrivateKey // nil if checkpoints are disabled
+}
+
+// Returns the hash by which the record serialized as line is referred to by the next record in the chain.
+func HashRecord(line []byte) string {
+	hash := sha256.Sum256(line)
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns a signed checkpoint of the current head of the chain.
+func (c *hashChain) checkpoint() ([]byte, error) {
+	checkpoint := Checkpoint{
+		Type:         CHECKPOINT_TYPE,
+		Labels:       map[string]string{"id": instanceID, "version": version},
+		Timestamp:    time.Now().UTC(),
+		PreviousHash: c.head,
+		PublicKey:    base64.StdEncoding.EncodeToString(c.key.Public().(ed25519.PublicKey)),
+	}
+	unsigned, err := json.Marshal(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, unsigned))
+	return json.Marshal(checkpoint)
+}
+
+// Loads an Ed25519 private key from a PEM-encoded PKCS #8 file, such as one produced by
+// `openssl genpkey -algorithm ed25519`.
+func LoadPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key in %s: %w", filename, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is a %T, not an Ed25519 key", filename, key)
+	}
+	return edKey, nil
+}
+
+// Loads an Ed25519 public key from a PEM-encoded file, which may contain either a public key (such as one produced by
+// `openssl pkey -pubout`) or a private key, from which the public key is derived.
+func LoadPublicKey(filename string) (ed25519.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		privateKey, err := LoadPrivateKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey.Public().(ed25519.PublicKey), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key in %s: %w", filename, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is a %T, not an Ed25519 key", filename, key)
+	}
+	return edKey, nil
+}
+
+func readPEM(filename string) (*pem.Block, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", filename)
+	}
+	return block, nil
+}
+
+// Returns the last non-empty line of filename, or nil if the file is empty or does not exist.
+func lastLine(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read backwards in chunks until we have found the start of the last line
+	const chunkSize = 64 * 1024
+	var tail []byte
+	for offset := info.Size(); offset > 0; {
+		readSize := int64(chunkSize)
+		if offset < readSize {
+			readSize = offset
+		}
+		offset -= readSize
+		chunk := make([]byte, readSize)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+		if offset == 0 && len(trimmed) > 0 {
+			return trimmed, nil
+		}
+	}
+	return nil, nil
+}
+
+// Opens a decision log file for reading, transparently decompressing it if it is a gzipped rotated file.
+func OpenFile(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, o11y.COMPRESSED_FILE_SUFFIX) {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to decompress %s: %w", filename, err)
+	}
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if closeErr := g.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// The outcome of verifying one or more decision log files.
+type VerificationResult struct {
+	Records                int
+	Checkpoints            int
+	VerifiedCheckpoints    int
+	RecordsAfterCheckpoint int
+	// The hash of the last record read, which the first record of the next file to be verified should have as its
+	// previous_hash
+	LastHash string
+	// Empty if and only if the chain is intact
+	Break     string
+	BreakFile string
+	BreakLine int
+}
+
+// Walks the decision log files in order, checking that every record's previous_hash matches the hash of the record
+// before it (including across files, which may be gzipped) and, if publicKey is not nil, that every checkpoint is signed by publicKey.
+// The previous_hash of the very first record must be firstHash; if firstHash is empty it is not checked, so records
+// removed from the start of the log cannot be detected. Stops at the first break in the chain.
+func Verify(filenames []string, publicKey ed25519.PublicKey, firstHash string) (VerificationResult, error) {
+	result := VerificationResult{}
+	previousHash := firstHash
+	for _, filename := range filenames {
+		f, err := OpenFile(filename)
+		if err != nil {
+			return result, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+
+			brokenBecause := func(format string, args ...interface{}) (VerificationResult, error) {
+				f.Close()
+				result.Break = fmt.Sprintf(format, args...)
+				result.BreakFile = filename
+				result.BreakLine = lineNumber
+				return result, nil
+			}
+
+			var record Checkpoint
+			if err := json.Unmarshal(line, &record); err != nil {
+				return brokenBecause("unable to parse record: %s", err)
+			}
+			if record.PreviousHash == "" {
+				return brokenBecause("record has no previous_hash")
+			}
+			if previousHash != "" && record.PreviousHash != previousHash && result.LastHash == "" {
+				return brokenBecause("previous_hash of the first record is %s but %s was expected; records may have been removed from the start of the log", record.PreviousHash, previousHash)
+			}
+			if previousHash != "" && record.PreviousHash != previousHash {
+				return brokenBecause("previous_hash is %s but the previous record hashes to %s", record.PreviousHash, previousHash)
+			}
+			previousHash = HashRecord(line)
+			result.LastHash = previousHash
+
+			if record.Type != CHECKPOINT_TYPE {
+				result.Records++
+				result.RecordsAfterCheckpoint++
+				continue
+			}
+
+			result.Checkpoints++
+			if publicKey == nil {
+				continue
+			}
+			if record.PublicKey != base64.StdEncoding.EncodeToString(publicKey) {
+				return brokenBecause("checkpoint was signed by a different key (%s)", record.PublicKey)
+			}
+			signature, err := base64.StdEncoding.DecodeString(record.Signature)
+			if err != nil {
+				return brokenBecause("unable to decode checkpoint signature: %s", err)
+			}
+			record.Signature = ""
+			unsigned, err := json.Marshal(record)
+			if err != nil {
+				return brokenBecause("unable to serialize checkpoint: %s", err)
+			}
+			if !ed25519.Verify(publicKey, unsigned, signature) {
+				return brokenBecause("checkpoint signature is invalid")
+			}
+			result.VerifiedCheckpoints++
+			result.RecordsAfterCheckpoint = 0
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return result, fmt.Errorf("unable to read %s: %w", filename, err)
+		}
+	}
+	return result, nil
+}
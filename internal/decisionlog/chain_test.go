@@ -0,0 +1,317 @@
+package decisionlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+)
+
+func TestVerify(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Six decisions, with a checkpoint after every third, so lines 4 and 8 (counting from 1) are checkpoints
+	chain := &hashChain{head: GENESIS_HASH, key: key}
+	lines := [][]byte{}
+	for i := 0; i < 6; i++ {
+		line, err := json.Marshal(map[string]string{"decision_id": fmt.Sprintf("decision-%d", i), "previous_hash": chain.head})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+		chain.head = HashRecord(line)
+		if i%3 == 2 {
+			checkpoint, err := chain.checkpoint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, checkpoint)
+			chain.head = HashRecord(checkpoint)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		mutate    func(lines [][]byte) [][]byte
+		gzip      bool
+		firstHash string
+		publicKey ed25519.PublicKey
+		// Empty if the chain should be intact
+		breakContains string
+		breakLine     int
+		records       int
+	}{
+		{name: "intact", firstHash: GENESIS_HASH, publicKey: publicKey, records: 6},
+		{name: "intact without key", records: 6},
+		{name: "intact with gzipped first file", gzip: true, firstHash: GENESIS_HASH, publicKey: publicKey, records: 6},
+		{
+			name: "tampered",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[1] = bytes.Replace(lines[1], []byte("decision-1"), []byte("decision-X"), 1)
+				return lines
+			},
+			breakContains: "but the previous record hashes to",
+			breakLine:     3,
+		},
+		{
+			name: "deleted",
+			mutate: func(lines [][]byte) [][]byte {
+				return append(lines[:1], lines[2:]...)
+			},
+			breakContains: "but the previous record hashes to",
+			breakLine:     2,
+		},
+		{
+			name: "deleted from the start",
+			mutate: func(lines [][]byte) [][]byte {
+				return lines[1:]
+			},
+			firstHash:     GENESIS_HASH,
+			breakContains: "removed from the start of the log",
+			breakLine:     1,
+		},
+		{
+			name: "deleted from the start without first hash",
+			mutate: func(lines [][]byte) [][]byte {
+				return lines[1:]
+			},
+			records: 5,
+		},
+		{
+			name: "reordered",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			breakContains: "but the previous record hashes to",
+			breakLine:     2,
+		},
+		{
+			name: "reordered across files",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[3], lines[4] = lines[4], lines[3]
+				return lines
+			},
+			gzip:          true,
+			breakContains: "but the previous record hashes to",
+			breakLine:     4,
+		},
+		{
+			name: "forged checkpoint",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[3] = bytes.Replace(lines[3], []byte(`"labels":{`), []byte(`"labels":{"forged":"true",`), 1)
+				return lines
+			},
+			publicKey:     publicKey,
+			breakContains: "checkpoint signature is invalid",
+			breakLine:     4,
+		},
+		{name: "wrong key", publicKey: otherPublicKey, breakContains: "signed by a different key", breakLine: 4},
+		{
+			name: "unparseable",
+			mutate: func(lines [][]byte) [][]byte {
+				lines[2] = []byte("not json")
+				return lines
+			},
+			breakContains: "unable to parse record",
+			breakLine:     3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mutated := make([][]byte, len(lines))
+			for i, line := range lines {
+				mutated[i] = append([]byte{}, line...)
+			}
+			if test.mutate != nil {
+				mutated = test.mutate(mutated)
+			}
+
+			// Split the log after the first checkpoint, as rotation would
+			directory := t.TempDir()
+			first := filepath.Join(directory, "decisions.log.1")
+			if test.gzip {
+				first += o11y.COMPRESSED_FILE_SUFFIX
+			}
+			second := filepath.Join(directory, "decisions.log")
+			writeLines(t, first, mutated[:4], test.gzip)
+			writeLines(t, second, mutated[4:], false)
+
+			result, err := Verify([]string{first, second}, test.publicKey, test.firstHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.breakContains == "" {
+				if result.Break != "" {
+					t.Fatalf("expected the chain to be intact, got a break at %s:%d: %s", result.BreakFile, result.BreakLine, result.Break)
+				}
+				if result.Records != test.records {
+					t.Fatalf("expected %d records, got %d", test.records, result.Records)
+				}
+				if result.LastHash != HashRecord(mutated[len(mutated)-1]) {
+					t.Fatalf("expected the last hash to be the hash of the last line, got %s", result.LastHash)
+				}
+				if test.publicKey != nil && (result.VerifiedCheckpoints != 2 || result.RecordsAfterCheckpoint != 0) {
+					t.Fatalf("expected 2 verified checkpoints covering every record, got %d with %d records after", result.VerifiedCheckpoints, result.RecordsAfterCheckpoint)
+				}
+				return
+			}
+			if !strings.Contains(result.Break, test.breakContains) {
+				t.Fatalf("expected a break containing %q, got %q", test.breakContains, result.Break)
+			}
+			// Line numbers are within each file, and the second file starts at the fifth line
+			breakLine := result.BreakLine
+			if result.BreakFile == second {
+				breakLine += 4
+			}
+			if breakLine != test.breakLine {
+				t.Fatalf("expected a break at line %d, got %s:%d", test.breakLine, result.BreakFile, result.BreakLine)
+			}
+		})
+	}
+}
+
+// Logs enough decisions to rotate the decision log several times, then checks that every rotated file ends with a
+// checkpoint and that the files verify as a single chain.
+func TestVerifyAcrossRotation(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := t.TempDir()
+	keyFile := filepath.Join(directory, "checkpoint.pem")
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(directory, "decisions.log")
+	cfg := config.DefaultConfiguration()
+	cfg.DecisionLog.Enabled = true
+	cfg.DecisionLog.Filename = filename
+	cfg.DecisionLog.HashChain.Enabled = true
+	cfg.DecisionLog.HashChain.CheckpointKeyFile = keyFile
+	cfg.DecisionLog.HashChain.CheckpointInterval = 0
+	cfg.DecisionLog.Rotation = config.LogRotation{MaxBytes: 2000, MaxBackups: 0, Compress: true}
+	config.ConfigurationPointer.Store(cfg)
+	// Start a new chain rather than continuing one left over from another test
+	decisionLogSettings.mutex.Lock()
+	decisionLogSettings.chain = nil
+	decisionLogSettings.mutex.Unlock()
+	if err := Configure(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		decision := NewDecision(time.Now(), "test")
+		decision.Input = map[string]interface{}{"request": map[string]interface{}{"uri": fmt.Sprintf("/v1.43/containers/%d/json", i)}}
+		decision.Result = map[string]interface{}{"ok": true}
+		Log(decision)
+	}
+	Close()
+
+	// Rotated files are compressed in the background
+	var rotated []string
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		rotated, err = filepath.Glob(filename + ".*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed := 0
+		for _, name := range rotated {
+			if strings.HasSuffix(name, o11y.COMPRESSED_FILE_SUFFIX) {
+				compressed++
+			}
+		}
+		if len(rotated) > 0 && compressed == len(rotated) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated files were not all compressed: %v", rotated)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sort.Strings(rotated)
+	if len(rotated) < 2 {
+		t.Fatalf("expected the decision log to be rotated at least twice, got %v", rotated)
+	}
+
+	for _, name := range append(rotated, filename) {
+		f, err := OpenFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var last []byte
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			last = append([]byte{}, scanner.Bytes()...)
+		}
+		f.Close()
+		if last == nil && name == filename {
+			// The checkpoint written on close rotated the file, leaving the current one empty
+			continue
+		}
+		var record Checkpoint
+		if err := json.Unmarshal(last, &record); err != nil {
+			t.Fatalf("unable to parse the last line of %s: %s", name, err)
+		}
+		if record.Type != CHECKPOINT_TYPE {
+			t.Fatalf("expected %s to end with a checkpoint, got %s", name, last)
+		}
+	}
+
+	result, err := Verify(append(rotated, filename), publicKey, GENESIS_HASH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Break != "" {
+		t.Fatalf("expected the chain to be intact, got a break at %s:%d: %s", result.BreakFile, result.BreakLine, result.Break)
+	}
+	if result.Records != 20 || result.RecordsAfterCheckpoint != 0 {
+		t.Fatalf("expected 20 records all covered by checkpoints, got %d with %d after the last checkpoint", result.Records, result.RecordsAfterCheckpoint)
+	}
+}
+
+func writeLines(t *testing.T, filename string, lines [][]byte, compress bool) {
+	t.Helper()
+	contents := append(bytes.Join(lines, []byte("\n")), '\n')
+	if compress {
+		var buffer bytes.Buffer
+		gz := gzip.NewWriter(&buffer)
+		if _, err := gz.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		contents = buffer.Bytes()
+	}
+	if err := os.WriteFile(filename, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,323 @@
+package decisionlog
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/mjec/docker-socket-authorizer/internal/redact"
+	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"golang.org/x/exp/slog"
+)
+
+// A single authorization decision, serialized using the same schema as OPA's decision logs
+// (https://www.openpolicyagent.org/docs/v0.55.0/management-decision-logs/).
+type Decision struct {
+	Labels     map[string]string     `json:"labels"`
+	DecisionID string                `json:"decision_id"`
+	Bundles    map[string]BundleInfo `json:"bundles,omitempty"`
+	Path       string                `json:"path,omitempty"`
+	Input      interface{}           `json:"input,omitempty"`
+	Result     interface{}           `json:"result,omitempty"`
+	// The results of nondeterministic builtins (e.g. dns.ptr) called during evaluation, which allow it to be replayed
+	NDBuiltinCache interface{}            `json:"nd_builtin_cache,omitempty"`
+	Erased         []string               `json:"erased,omitempty"`
+	Masked         []string               `json:"masked,omitempty"`
+	Error          *DecisionError         `json:"error,omitempty"`
+	RequestedBy    string                 `json:"requested_by,omitempty"`
+	Timestamp      time.Time              `json:"timestamp"`
+	Metrics        map[string]interface{} `json:"metrics,omitempty"`
+	// Only set if decision_log.hash_chain.enabled is true; the hash of the previous record in the log
+	PreviousHash string `json:"previous_hash,omitempty"`
+
+	startTime time.Time
+}
+
+type BundleInfo struct {
+	Revision string `json:"revision,omitempty"`
+}
+
+type DecisionError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// The name under which the policy revision is reported in the bundles field of each decision
+const BUNDLE_NAME = "docker_socket_authorizer"
+
+var (
+	// Identifies this process in the labels of every decision, as OPA does with its instance ID
+	instanceID string = newDecisionID()
+	version    string = readVersion()
+
+	decisionLogSettings = struct {
+		mutex      *sync.Mutex
+		output     io.Writer
+		fileCloser io.Closer
+		chain      *hashChain // nil if the hash chain is disabled
+	}{
+		mutex:      &sync.Mutex{},
+		output:     nil,
+		fileCloser: nil,
+		chain:      nil,
+	}
+)
+
+// Starts a new decision, which should be completed by setting its fields and then passed to Log(). The timestamp
+// and handler latency of the decision are measured from startTime.
+func NewDecision(startTime time.Time, requestedBy string) *Decision {
+	return &Decision{
+		Labels: map[string]string{
+			"id":      instanceID,
+			"version": version,
+		},
+		DecisionID:  newDecisionID(),
+		Path:        BUNDLE_NAME,
+		RequestedBy: requestedBy,
+		Timestamp:   startTime.UTC(),
+		Metrics:     map[string]interface{}{},
+		startTime:   startTime,
+	}
+}
+
+// Records the policy revision used to reach this decision.
+func (d *Decision) SetRevision(revision string) {
+	d.Bundles = map[string]BundleInfo{BUNDLE_NAME: {Revision: revision}}
+}
+
+// Records that this decision could not be reached because of err.
+func (d *Decision) SetError(code string, err error) {
+	d.Error = &DecisionError{Code: code, Message: err.Error()}
+}
+
+func InitializeDecisionLog(cfg *config.Configuration) error {
+	if err := Configure(); err != nil {
+		return err
+	}
+	if cfg.DecisionLog.Enabled {
+		if err := startUploader(cfg); err != nil {
+			return err
+		}
+	}
+	defer shutdown.OnShutdown("decision log", func() {
+		// Requests which are still draining may yet log decisions
+		shutdown.WaitForDrain()
+		Close()
+		stopUploader()
+	})
+	return nil
+}
+
+// (Re)opens the decision log file. Thread safe; protected by a mutex.
+func Configure() error {
+	decisionLogSettings.mutex.Lock()
+	defer decisionLogSettings.mutex.Unlock()
+	cfg := config.ConfigurationPointer.Load()
+
+	// Checkpoint before we (potentially) move to a new file, so everything in the old file is covered by a signature.
+	// This also means the checkpoint is included when we pick up the chain from the end of the file below.
+	if chain := decisionLogSettings.chain; chain != nil && chain.key != nil && chain.recordsSinceCheckpoint > 0 {
+		writeCheckpoint(chain)
+	}
+
+	var newChain *hashChain = nil
+	if cfg.DecisionLog.Enabled && cfg.DecisionLog.HashChain.Enabled {
+		newChain = &hashChain{
+			head:               GENESIS_HASH,
+			checkpointInterval: cfg.DecisionLog.HashChain.CheckpointInterval,
+		}
+		if decisionLogSettings.chain != nil {
+			newChain.head = decisionLogSettings.chain.head
+			newChain.recordsSinceCheckpoint = decisionLogSettings.chain.recordsSinceCheckpoint
+		}
+		if cfg.DecisionLog.HashChain.CheckpointKeyFile != "" {
+			key, err := LoadPrivateKey(cfg.DecisionLog.HashChain.CheckpointKeyFile)
+			if err != nil {
+				return fmt.Errorf("unable to load decision log checkpoint key: %w", err)
+			}
+			newChain.key = key
+		}
+	}
+
+	var newOutput io.Writer = nil
+	var newFileCloser io.Closer = nil
+	if cfg.DecisionLog.Enabled && cfg.DecisionLog.Filename != "none" {
+		if newChain != nil && cfg.DecisionLog.Filename != "stdout" && cfg.DecisionLog.Filename != "stderr" {
+			// Continue the chain from the end of an existing file, so restarts don't break it. If the file is empty
+			// (e.g. it has just been rotated) we continue from wherever we were, linking the files together.
+			last, err := lastLine(cfg.DecisionLog.Filename)
+			if err != nil {
+				return fmt.Errorf("unable to read the end of the decision log to continue its hash chain: %w", err)
+			}
+			if last != nil {
+				newChain.head = HashRecord(last)
+			}
+		}
+
+		output, closer, err := o11y.OpenRotatingLogFile(cfg.DecisionLog.Filename, "decision_log.rotation", cfg.DecisionLog.Rotation)
+		if err != nil {
+			return fmt.Errorf("unable to open decision log: %w", err)
+		}
+		newOutput = output
+		newFileCloser = closer
+	}
+
+	closeOutput()
+	decisionLogSettings.output = newOutput
+	decisionLogSettings.fileCloser = newFileCloser
+	decisionLogSettings.chain = newChain
+
+	return nil
+}
+
+// Closes the decision log file, after which decisions are no longer logged until Configure() is called again.
+func Close() {
+	decisionLogSettings.mutex.Lock()
+	defer decisionLogSettings.mutex.Unlock()
+
+	closeOutput()
+	decisionLogSettings.output = nil
+	decisionLogSettings.fileCloser = nil
+}
+
+// Closes the current output, first writing a checkpoint if there are any records since the last one. Must be called
+// with decisionLogSettings.mutex held.
+func closeOutput() {
+	if chain := decisionLogSettings.chain; chain != nil && chain.key != nil && chain.recordsSinceCheckpoint > 0 {
+		writeCheckpoint(chain)
+	}
+	if decisionLogSettings.fileCloser != nil {
+		decisionLogSettings.fileCloser.Close()
+	}
+}
+
+// Must be called with decisionLogSettings.mutex held.
+func writeCheckpoint(chain *hashChain) {
+	line, err := chain.checkpoint()
+	if err != nil {
+		slog.Error("Unable to create decision log checkpoint", slog.Any("error", err))
+		return
+	}
+	chain.recordsSinceCheckpoint = 0
+
+	// The checkpoint covers the records before it, so if writing it would rotate the file it goes at the end of the
+	// file being rotated rather than the start of the new one
+	if rotator, ok := decisionLogSettings.output.(o11y.Rotator); ok && rotator.DueForRotation(len(line)+1) {
+		chain.head = HashRecord(line)
+		if err := rotator.RotateAfter(append(line, '\n')); err != nil {
+			slog.Error("Unable to rotate decision log", slog.Any("error", err))
+		}
+		return
+	}
+	writeLine(line)
+}
+
+// Writes a checkpoint if the decision log file is due to be rotated before a write of writeSize bytes, so that the
+// rotated file ends with one. Returns true if it did, in which case the head of the chain has moved. Must be called
+// with decisionLogSettings.mutex held.
+func checkpointBeforeRotation(writeSize int) bool {
+	chain := decisionLogSettings.chain
+	if chain == nil || chain.key == nil || chain.recordsSinceCheckpoint == 0 {
+		return false
+	}
+	rotator, ok := decisionLogSettings.output.(o11y.Rotator)
+	if !ok || !rotator.DueForRotation(writeSize) {
+		return false
+	}
+	writeCheckpoint(chain)
+	return true
+}
+
+// Writes line to the decision log file, advancing the hash chain (if any). Must be called with
+// decisionLogSettings.mutex held.
+func writeLine(line []byte) {
+	if decisionLogSettings.chain != nil {
+		decisionLogSettings.chain.head = HashRecord(line)
+	}
+
+	if decisionLogSettings.output == nil {
+		return
+	}
+	if _, err := decisionLogSettings.output.Write(append(line, '\n')); err != nil {
+		slog.Error("Unable to write to decision log", slog.Any("error", err))
+	}
+}
+
+// Writes decision to the decision log as a single JSON line and queues it for upload, if the decision log is enabled.
+// Thread safe; protected by a mutex. Errors are logged rather than returned, as there is nothing the caller can
+// usefully do about them.
+func Log(decision *Decision) {
+	decision.Metrics["timer_server_handler_ns"] = time.Since(decision.startTime).Nanoseconds()
+
+	if !config.ConfigurationPointer.Load().DecisionLog.Enabled {
+		return
+	}
+
+	redacted, masked, erased, err := redact.Redact(map[string]interface{}{"input": decision.Input, "result": decision.Result})
+	if err != nil {
+		slog.Error("Unable to redact decision; not logging it", slog.Any("error", err), slog.String("decision_id", decision.DecisionID))
+		return
+	}
+	decision.Input = redacted.(map[string]interface{})["input"]
+	decision.Result = redacted.(map[string]interface{})["result"]
+	decision.Masked = masked
+	decision.Erased = erased
+
+	// Each record in the hash chain depends on the one before it, so from here on records must be serialized in the
+	// same order they are written
+	decisionLogSettings.mutex.Lock()
+	defer decisionLogSettings.mutex.Unlock()
+
+	chain := decisionLogSettings.chain
+	if chain != nil {
+		decision.PreviousHash = chain.head
+	}
+
+	line, err := json.Marshal(decision)
+	if err != nil {
+		slog.Error("Unable to marshal decision to JSON (likely a bug)", slog.Any("error", err), slog.String("decision_id", decision.DecisionID))
+		return
+	}
+	if checkpointBeforeRotation(len(line) + 1) {
+		// Link the decision to the checkpoint that now ends the file being rotated
+		decision.PreviousHash = chain.head
+		if line, err = json.Marshal(decision); err != nil {
+			slog.Error("Unable to marshal decision to JSON (likely a bug)", slog.Any("error", err), slog.String("decision_id", decision.DecisionID))
+			return
+		}
+	}
+	writeLine(line)
+	// Only decisions are uploaded; checkpoints only mean anything alongside the file they were written to
+	enqueueForUpload(line)
+
+	if chain != nil && chain.key != nil {
+		chain.recordsSinceCheckpoint++
+		if chain.checkpointInterval > 0 && chain.recordsSinceCheckpoint >= chain.checkpointInterval {
+			writeCheckpoint(chain)
+		}
+	}
+}
+
+// Generates a random (version 4) UUID.
+func newDecisionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("unable to read random bytes for decision ID: %w", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func readVersion() string {
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		return buildInfo.Main.Version
+	}
+	return "unknown"
+}
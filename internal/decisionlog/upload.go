@@ -0,0 +1,357 @@
+package decisionlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"golang.org/x/exp/slog"
+)
+
+// Uploads decision log records in batches to an HTTP endpoint, in the same way OPA uploads decision logs: a POST of a
+// gzipped JSON array of records. All uploading happens on a single background goroutine; the only thing that happens
+// on the request path is a non-blocking send to a bounded channel, so authorization latency never depends on the sink.
+type uploader struct {
+	client          *http.Client
+	url             string
+	batchSize       int
+	flushInterval   time.Duration
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	bufferDirectory string // if empty, failed batches are retried from memory
+	bufferMaxBytes  int64
+
+	records chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+	// Canceled to abandon uploads in progress, once shutdown hooks have run out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Only accessed from the run() goroutine
+	failures    int
+	nextAttempt time.Time
+	spoolSerial int
+}
+
+const SPOOL_FILE_SUFFIX = ".json.gz"
+
+// How long before shutdown hooks run out of time to abandon uploads, leaving time to record that their records were
+// dropped before we exit
+const ABANDON_UPLOADS_BEFORE_SHUTDOWN_DEADLINE = 100 * time.Millisecond
+
+var activeUploader atomic.Pointer[uploader] = atomic.Pointer[uploader]{}
+
+// Starts uploading decisions, if decision_log.upload.url is set. Changes to the upload configuration take effect on
+// restart only.
+func startUploader(cfg *config.Configuration) error {
+	uploadCfg := cfg.DecisionLog.Upload
+	if uploadCfg.Url == "" {
+		return nil
+	}
+	if uploadCfg.BatchSize <= 0 || uploadCfg.BufferSize <= 0 || uploadCfg.FlushIntervalSeconds <= 0 {
+		return fmt.Errorf("decision_log.upload.batch_size, buffer_size and flush_interval_seconds must all be positive")
+	}
+	if uploadCfg.TimeoutSeconds <= 0 || uploadCfg.MinBackoffSeconds <= 0 || uploadCfg.MaxBackoffSeconds <= 0 {
+		// A zero timeout would fail every upload, and zero backoffs would retry a failing collector in a tight loop
+		return fmt.Errorf("decision_log.upload.timeout_seconds, min_backoff_seconds and max_backoff_seconds must all be positive")
+	}
+	if uploadCfg.MinBackoffSeconds > uploadCfg.MaxBackoffSeconds {
+		return fmt.Errorf("decision_log.upload.min_backoff_seconds must not be greater than max_backoff_seconds")
+	}
+	if uploadCfg.BufferDirectory != "" {
+		if err := os.MkdirAll(uploadCfg.BufferDirectory, 0700); err != nil {
+			return fmt.Errorf("unable to create decision log buffer directory: %w", err)
+		}
+	}
+
+	u := &uploader{
+		client:          &http.Client{Timeout: time.Duration(uploadCfg.TimeoutSeconds) * time.Second},
+		url:             uploadCfg.Url,
+		batchSize:       uploadCfg.BatchSize,
+		flushInterval:   time.Duration(uploadCfg.FlushIntervalSeconds) * time.Second,
+		minBackoff:      time.Duration(uploadCfg.MinBackoffSeconds) * time.Second,
+		maxBackoff:      time.Duration(uploadCfg.MaxBackoffSeconds) * time.Second,
+		bufferDirectory: uploadCfg.BufferDirectory,
+		bufferMaxBytes:  int64(uploadCfg.BufferDirectoryMaxBytes),
+		records:         make(chan []byte, uploadCfg.BufferSize),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+	if !activeUploader.CompareAndSwap(nil, u) {
+		return fmt.Errorf("decision log uploader already started (likely a bug)")
+	}
+	go u.run()
+	slog.Info("Started decision log uploader", slog.String("url", u.url))
+	return nil
+}
+
+// Stops the uploader, waiting until records already buffered in memory have been uploaded (once) or, if there is a
+// buffer directory, written to disk. Uploads still in progress when shutdown hooks run out of time are abandoned, and
+// their records dropped unless there is a buffer directory to write them to.
+func stopUploader() {
+	u := activeUploader.Swap(nil)
+	if u == nil {
+		return
+	}
+	close(u.stop)
+
+	var abandon <-chan time.Time = nil // never
+	if deadline, ok := shutdown.Context().Deadline(); ok {
+		abandon = time.After(time.Until(deadline) - ABANDON_UPLOADS_BEFORE_SHUTDOWN_DEADLINE)
+	}
+	select {
+	case <-u.done:
+	case <-abandon:
+		u.cancel()
+		<-u.done
+	}
+	u.cancel()
+}
+
+// Queues a serialized record for upload without blocking, dropping it if the buffer is full.
+func enqueueForUpload(record []byte) {
+	u := activeUploader.Load()
+	if u == nil {
+		return
+	}
+	select {
+	case u.records <- record:
+		o11y.Metrics.DecisionLogBuffered.Set(float64(len(u.records)))
+	default:
+		o11y.Metrics.DecisionLogDropped.WithLabelValues("buffer_full").Inc()
+	}
+}
+
+func (u *uploader) run() {
+	defer close(u.done)
+	ticker := time.NewTicker(u.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, u.batchSize)
+	for {
+		select {
+		case record := <-u.records:
+			batch = append(batch, record)
+			if len(batch) < u.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-u.stop:
+			u.shutdown(batch)
+			return
+		}
+		o11y.Metrics.DecisionLogBuffered.Set(float64(len(u.records)))
+
+		u.drainSpool()
+		if len(batch) > 0 {
+			u.deliver(batch)
+			batch = make([][]byte, 0, u.batchSize)
+		}
+	}
+}
+
+func (u *uploader) shutdown(batch [][]byte) {
+	for len(u.records) > 0 {
+		batch = append(batch, <-u.records)
+	}
+	o11y.Metrics.DecisionLogBuffered.Set(0)
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := encodeBatch(batch)
+	if err != nil {
+		slog.Error("Unable to encode decision log batch; dropping it", slog.Any("error", err), slog.Int("records", len(batch)))
+		o11y.Metrics.DecisionLogDropped.WithLabelValues("encoding_error").Add(float64(len(batch)))
+		return
+	}
+	if u.bufferDirectory != "" {
+		// We'll pick this up on the next start
+		u.spool(body, len(batch))
+		return
+	}
+	if err := u.upload(body); err != nil {
+		slog.Warn("Unable to upload decision log batch on shutdown; dropping it", slog.Any("error", err), slog.Int("records", len(batch)))
+		o11y.Metrics.DecisionLogDropped.WithLabelValues("shutdown").Add(float64(len(batch)))
+	}
+}
+
+// Delivers a batch, either by uploading it or (if there is a buffer directory) writing it to disk to be uploaded
+// later. Without a buffer directory, this retries with exponential backoff until the upload succeeds or we are
+// stopped; meanwhile new records accumulate in (and may overflow) the in-memory buffer.
+func (u *uploader) deliver(batch [][]byte) {
+	body, err := encodeBatch(batch)
+	if err != nil {
+		slog.Error("Unable to encode decision log batch; dropping it", slog.Any("error", err), slog.Int("records", len(batch)))
+		o11y.Metrics.DecisionLogDropped.WithLabelValues("encoding_error").Add(float64(len(batch)))
+		return
+	}
+
+	if u.bufferDirectory != "" {
+		// Preserve ordering: if anything is already waiting on disk, this batch has to wait behind it
+		if time.Now().Before(u.nextAttempt) || len(u.spooledFiles()) > 0 || !u.tryUpload(body) {
+			u.spool(body, len(batch))
+		}
+		return
+	}
+
+	for !u.tryUpload(body) {
+		select {
+		case <-time.After(time.Until(u.nextAttempt)):
+		case <-u.stop:
+			slog.Warn("Decision log uploader stopped while retrying; dropping batch", slog.Int("records", len(batch)))
+			o11y.Metrics.DecisionLogDropped.WithLabelValues("shutdown").Add(float64(len(batch)))
+			return
+		}
+	}
+}
+
+// Uploads spooled batches, oldest first, until one fails or there are none left.
+func (u *uploader) drainSpool() {
+	if u.bufferDirectory == "" {
+		return
+	}
+	for _, file := range u.spooledFiles() {
+		if time.Now().Before(u.nextAttempt) {
+			return
+		}
+		body, err := os.ReadFile(file)
+		if err != nil {
+			slog.Error("Unable to read spooled decision log batch; skipping it", slog.Any("error", err), slog.String("file", file))
+			continue
+		}
+		if !u.tryUpload(body) {
+			return
+		}
+		if err := os.Remove(file); err != nil {
+			slog.Error("Unable to remove uploaded decision log batch; it may be uploaded again", slog.Any("error", err), slog.String("file", file))
+		}
+	}
+}
+
+// Attempts a single upload, updating backoff state and metrics. Returns true on success.
+func (u *uploader) tryUpload(body []byte) bool {
+	if err := u.upload(body); err != nil {
+		u.failures++
+		backoff := u.maxBackoff
+		// Beyond 30 doublings we're certainly at the maximum (and would risk overflowing)
+		if u.failures <= 30 && u.minBackoff<<(u.failures-1) < u.maxBackoff {
+			backoff = u.minBackoff << (u.failures - 1)
+		}
+		// Jitter by up to 20% so many hosts don't retry in lockstep against a recovering collector
+		backoff += time.Duration(rand.Int63n(int64(backoff)/5 + 1))
+		u.nextAttempt = time.Now().Add(backoff)
+		o11y.Metrics.DecisionLogUploadErrors.Inc()
+		slog.Warn("Unable to upload decision log batch", slog.Any("error", err), slog.Float64("retry_in_seconds", backoff.Seconds()))
+		return false
+	}
+	u.failures = 0
+	u.nextAttempt = time.Time{}
+	o11y.Metrics.DecisionLogUploads.Inc()
+	return true
+}
+
+func (u *uploader) upload(body []byte) error {
+	ctx, cancel := context.WithTimeout(u.ctx, u.client.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	request.Header.Set("content-encoding", "gzip")
+
+	response, err := u.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	return nil
+}
+
+// Writes an encoded batch to the buffer directory, unless that would take it over its size limit.
+func (u *uploader) spool(body []byte, records int) {
+	if u.bufferMaxBytes > 0 && u.spoolSize()+int64(len(body)) > u.bufferMaxBytes {
+		slog.Warn("Decision log buffer directory is full; dropping batch", slog.Int("records", records))
+		o11y.Metrics.DecisionLogDropped.WithLabelValues("buffer_full").Add(float64(records))
+		return
+	}
+	u.spoolSerial++
+	// Names sort in the order batches were written, which is the order we upload them in
+	name := filepath.Join(u.bufferDirectory, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), u.spoolSerial%1000000, SPOOL_FILE_SUFFIX))
+	if err := os.WriteFile(name, body, 0600); err != nil {
+		slog.Error("Unable to write decision log batch to buffer directory; dropping it", slog.Any("error", err), slog.Int("records", records))
+		o11y.Metrics.DecisionLogDropped.WithLabelValues("buffer_error").Add(float64(records))
+	}
+}
+
+func (u *uploader) spooledFiles() []string {
+	entries, err := os.ReadDir(u.bufferDirectory)
+	if err != nil {
+		slog.Error("Unable to read decision log buffer directory", slog.Any("error", err))
+		return nil
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), SPOOL_FILE_SUFFIX) {
+			files = append(files, filepath.Join(u.bufferDirectory, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (u *uploader) spoolSize() int64 {
+	var total int64
+	for _, file := range u.spooledFiles() {
+		if info, err := os.Stat(file); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// Encodes serialized records as a gzipped JSON array.
+func encodeBatch(batch [][]byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	if _, err := gz.Write([]byte{'['}); err != nil {
+		return nil, err
+	}
+	for i, record := range batch {
+		if i > 0 {
+			if _, err := gz.Write([]byte{','}); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := gz.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := gz.Write([]byte{']'}); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,198 @@
+package decisionlog
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in for a decision log collector, which fails the first failures uploads it receives
+type collector struct {
+	mutex    *sync.Mutex
+	failures int
+	attempts []time.Time
+	batches  [][]string // the decision IDs in each batch received successfully
+	errors   []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.attempts = append(c.attempts, time.Now())
+	if len(c.attempts) <= c.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodPost || r.Header.Get("content-type") != "application/json" || r.Header.Get("content-encoding") != "gzip" {
+		c.errors = append(c.errors, fmt.Sprintf("unexpected %s request with content-type %q and content-encoding %q", r.Method, r.Header.Get("content-type"), r.Header.Get("content-encoding")))
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		c.errors = append(c.errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var records []map[string]interface{}
+	if err := json.NewDecoder(gz).Decode(&records); err != nil {
+		c.errors = append(c.errors, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	batch := []string{}
+	for _, record := range records {
+		batch = append(batch, fmt.Sprint(record["decision_id"]))
+	}
+	c.batches = append(c.batches, batch)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *collector) received() ([][]string, []time.Time, []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([][]string{}, c.batches...), append([]time.Time{}, c.attempts...), append([]string{}, c.errors...)
+}
+
+func TestUploader(t *testing.T) {
+	const minBackoff = 20 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// How many uploads the collector fails before it starts accepting them
+		failures        int
+		bufferDirectory bool
+		// How often spooled batches are retried; otherwise, only full batches are uploaded before stopping
+		flushInterval time.Duration
+		records       int
+		// The batches expected by the collector, after stopping the uploader
+		expected [][]string
+		// How many of the expected batches are only uploaded when the uploader stops
+		uploadedOnStop int
+		// The number of batches expected to be left in the buffer directory after stopping the uploader
+		spooled int
+	}{
+		{
+			name:           "batches",
+			records:        7,
+			expected:       [][]string{{"0", "1", "2"}, {"3", "4", "5"}, {"6"}},
+			uploadedOnStop: 1,
+		},
+		{
+			name:     "retries with backoff",
+			failures: 2,
+			records:  3,
+			expected: [][]string{{"0", "1", "2"}},
+		},
+		{
+			name:            "replays spooled batches in order",
+			failures:        1,
+			bufferDirectory: true,
+			flushInterval:   50 * time.Millisecond,
+			records:         6,
+			expected:        [][]string{{"0", "1", "2"}, {"3", "4", "5"}},
+		},
+		{
+			name:            "spools on shutdown",
+			bufferDirectory: true,
+			records:         2,
+			expected:        [][]string{},
+			spooled:         1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &collector{mutex: &sync.Mutex{}, failures: test.failures}
+			server := httptest.NewServer(c)
+			defer server.Close()
+
+			u := &uploader{
+				client:        &http.Client{Timeout: time.Second},
+				url:           server.URL,
+				batchSize:     3,
+				flushInterval: time.Hour,
+				minBackoff:    minBackoff,
+				maxBackoff:    4 * minBackoff,
+				records:       make(chan []byte, 100),
+				stop:          make(chan struct{}),
+				done:          make(chan struct{}),
+			}
+			if test.bufferDirectory {
+				u.bufferDirectory = t.TempDir()
+			}
+			if test.flushInterval > 0 {
+				u.flushInterval = test.flushInterval
+			}
+			u.ctx, u.cancel = context.WithCancel(context.Background())
+			activeUploader.Store(u)
+
+			// Queue everything before starting, so records are batched the same way every time
+			for i := 0; i < test.records; i++ {
+				enqueueForUpload([]byte(fmt.Sprintf(`{"decision_id": "%d"}`, i)))
+			}
+			go u.run()
+
+			// Wait for what we expect to arrive before stopping, as stopping drops batches still being retried
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				batches, _, _ := c.received()
+				if len(batches) >= len(test.expected)-test.uploadedOnStop || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			stopUploader()
+
+			batches, attempts, errors := c.received()
+			if len(errors) > 0 {
+				t.Fatalf("collector received invalid uploads: %v", errors)
+			}
+			if !reflect.DeepEqual(batches, test.expected) {
+				t.Fatalf("expected batches %v, got %v", test.expected, batches)
+			}
+			for i := 1; i <= test.failures && i < len(attempts); i++ {
+				if gap := attempts[i].Sub(attempts[i-1]); gap < minBackoff {
+					t.Fatalf("expected at least %s between attempts %d and %d, got %s", minBackoff, i, i+1, gap)
+				}
+			}
+			if !test.bufferDirectory {
+				return
+			}
+
+			spooled, err := filepath.Glob(filepath.Join(u.bufferDirectory, "*"+SPOOL_FILE_SUFFIX))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(spooled) != test.spooled {
+				t.Fatalf("expected %d spooled batches, got %v", test.spooled, spooled)
+			}
+			for _, file := range spooled {
+				f, err := os.Open(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var records []map[string]interface{}
+				if err := json.NewDecoder(gz).Decode(&records); err != nil {
+					t.Fatalf("unable to decode spooled batch %s: %s", file, err)
+				}
+				f.Close()
+				if len(records) != test.records {
+					t.Fatalf("expected spooled batch to contain %d records, got %v", test.records, records)
+				}
+			}
+		})
+	}
+}
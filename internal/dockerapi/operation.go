@@ -0,0 +1,220 @@
+package dockerapi
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The operation for any request we can't classify
+const OTHER = "other"
+
+// A rule maps requests matching a method and path pattern to an operation. Each segment of the pattern is matched
+// against a segment of the path: "*" matches any one segment (such as a container ID), "**" matches one or more
+// segments (such as an image name, which may contain slashes), and anything else must match exactly.
+type rule struct {
+	method    string
+	pattern   []string
+	operation string
+}
+
+// Matches the optional API version prefix, e.g. "/v1.41"
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)?/`)
+
+// Based on the Docker Engine API reference (https://docs.docker.com/engine/api/latest/). Rules are tried in order, so
+// more specific patterns must come first.
+var rules = parseRules([][3]string{
+	{"GET", "/_ping", "system/ping"},
+	{"HEAD", "/_ping", "system/ping"},
+	{"GET", "/version", "system/version"},
+	{"GET", "/info", "system/info"},
+	{"GET", "/events", "system/events"},
+	{"GET", "/system/df", "system/df"},
+	{"POST", "/auth", "system/auth"},
+	{"POST", "/session", "system/session"},
+
+	{"GET", "/containers/json", "containers/list"},
+	{"POST", "/containers/create", "containers/create"},
+	{"POST", "/containers/prune", "containers/prune"},
+	{"GET", "/containers/*/json", "containers/inspect"},
+	{"GET", "/containers/*/top", "containers/top"},
+	{"GET", "/containers/*/logs", "containers/logs"},
+	{"GET", "/containers/*/changes", "containers/changes"},
+	{"GET", "/containers/*/export", "containers/export"},
+	{"GET", "/containers/*/stats", "containers/stats"},
+	{"POST", "/containers/*/resize", "containers/resize"},
+	{"POST", "/containers/*/start", "containers/start"},
+	{"POST", "/containers/*/stop", "containers/stop"},
+	{"POST", "/containers/*/restart", "containers/restart"},
+	{"POST", "/containers/*/kill", "containers/kill"},
+	{"POST", "/containers/*/update", "containers/update"},
+	{"POST", "/containers/*/rename", "containers/rename"},
+	{"POST", "/containers/*/pause", "containers/pause"},
+	{"POST", "/containers/*/unpause", "containers/unpause"},
+	{"POST", "/containers/*/attach", "containers/attach"},
+	{"GET", "/containers/*/attach/ws", "containers/attach"},
+	{"POST", "/containers/*/wait", "containers/wait"},
+	{"HEAD", "/containers/*/archive", "containers/archive-info"},
+	{"GET", "/containers/*/archive", "containers/archive"},
+	{"PUT", "/containers/*/archive", "containers/put-archive"},
+	{"DELETE", "/containers/*", "containers/delete"},
+
+	{"POST", "/containers/*/exec", "exec/create"},
+	{"POST", "/exec/*/start", "exec/start"},
+	{"POST", "/exec/*/resize", "exec/resize"},
+	{"GET", "/exec/*/json", "exec/inspect"},
+
+	{"GET", "/images/json", "images/list"},
+	{"POST", "/build", "images/build"},
+	{"POST", "/build/prune", "images/build-prune"},
+	{"POST", "/images/create", "images/pull"},
+	{"POST", "/images/load", "images/load"},
+	{"GET", "/images/get", "images/export"},
+	{"GET", "/images/search", "images/search"},
+	{"POST", "/images/prune", "images/prune"},
+	{"POST", "/commit", "images/commit"},
+	{"GET", "/images/**/json", "images/inspect"},
+	{"GET", "/images/**/history", "images/history"},
+	{"POST", "/images/**/push", "images/push"},
+	{"POST", "/images/**/tag", "images/tag"},
+	{"GET", "/images/**/get", "images/export"},
+	{"DELETE", "/images/**", "images/delete"},
+	{"GET", "/distribution/**/json", "distribution/inspect"},
+
+	{"GET", "/networks", "networks/list"},
+	{"POST", "/networks/create", "networks/create"},
+	{"POST", "/networks/prune", "networks/prune"},
+	{"GET", "/networks/*", "networks/inspect"},
+	{"DELETE", "/networks/*", "networks/delete"},
+	{"POST", "/networks/*/connect", "networks/connect"},
+	{"POST", "/networks/*/disconnect", "networks/disconnect"},
+
+	{"GET", "/volumes", "volumes/list"},
+	{"POST", "/volumes/create", "volumes/create"},
+	{"POST", "/volumes/prune", "volumes/prune"},
+	{"GET", "/volumes/*", "volumes/inspect"},
+	{"PUT", "/volumes/*", "volumes/update"},
+	{"DELETE", "/volumes/*", "volumes/delete"},
+
+	{"GET", "/swarm", "swarm/inspect"},
+	{"POST", "/swarm/init", "swarm/init"},
+	{"POST", "/swarm/join", "swarm/join"},
+	{"POST", "/swarm/leave", "swarm/leave"},
+	{"POST", "/swarm/update", "swarm/update"},
+	{"GET", "/swarm/unlockkey", "swarm/unlockkey"},
+	{"POST", "/swarm/unlock", "swarm/unlock"},
+
+	{"GET", "/nodes", "nodes/list"},
+	{"GET", "/nodes/*", "nodes/inspect"},
+	{"DELETE", "/nodes/*", "nodes/delete"},
+	{"POST", "/nodes/*/update", "nodes/update"},
+
+	{"GET", "/services", "services/list"},
+	{"POST", "/services/create", "services/create"},
+	{"GET", "/services/*", "services/inspect"},
+	{"DELETE", "/services/*", "services/delete"},
+	{"POST", "/services/*/update", "services/update"},
+	{"GET", "/services/*/logs", "services/logs"},
+
+	{"GET", "/tasks", "tasks/list"},
+	{"GET", "/tasks/*", "tasks/inspect"},
+	{"GET", "/tasks/*/logs", "tasks/logs"},
+
+	{"GET", "/secrets", "secrets/list"},
+	{"POST", "/secrets/create", "secrets/create"},
+	{"GET", "/secrets/*", "secrets/inspect"},
+	{"DELETE", "/secrets/*", "secrets/delete"},
+	{"POST", "/secrets/*/update", "secrets/update"},
+
+	{"GET", "/configs", "configs/list"},
+	{"POST", "/configs/create", "configs/create"},
+	{"GET", "/configs/*", "configs/inspect"},
+	{"DELETE", "/configs/*", "configs/delete"},
+	{"POST", "/configs/*/update", "configs/update"},
+
+	{"GET", "/plugins", "plugins/list"},
+	{"GET", "/plugins/privileges", "plugins/privileges"},
+	{"POST", "/plugins/pull", "plugins/pull"},
+	{"POST", "/plugins/create", "plugins/create"},
+	{"GET", "/plugins/**/json", "plugins/inspect"},
+	{"POST", "/plugins/**/enable", "plugins/enable"},
+	{"POST", "/plugins/**/disable", "plugins/disable"},
+	{"POST", "/plugins/**/upgrade", "plugins/upgrade"},
+	{"POST", "/plugins/**/push", "plugins/push"},
+	{"POST", "/plugins/**/set", "plugins/set"},
+	{"DELETE", "/plugins/**", "plugins/delete"},
+})
+
+func parseRules(definitions [][3]string) []rule {
+	output := make([]rule, 0, len(definitions))
+	for _, definition := range definitions {
+		output = append(output, rule{
+			method:    definition[0],
+			pattern:   strings.Split(strings.TrimPrefix(definition[1], "/"), "/"),
+			operation: definition[2],
+		})
+	}
+	return output
+}
+
+// Returns the Docker API operation (e.g. "containers/create") requested by method and uri, or OTHER if the request is
+// not one we recognise. The result is always one of a fixed set of values, so is safe to use as a metric label.
+func Operation(method string, uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return OTHER
+	}
+	path := versionPrefix.ReplaceAllString(parsed.Path, "/")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	method = strings.ToUpper(method)
+	for _, r := range rules {
+		if r.method == method && matches(r.pattern, segments) {
+			return r.operation
+		}
+	}
+	return OTHER
+}
+
+func matches(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	switch pattern[0] {
+	case "**":
+		// Consume as many segments as we can while still matching the rest of the pattern
+		for consumed := len(segments); consumed >= 1; consumed-- {
+			if segmentsNonEmpty(segments[:consumed]) && matches(pattern[1:], segments[consumed:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return segments[0] != "" && matches(pattern[1:], segments[1:])
+	default:
+		return pattern[0] == segments[0] && matches(pattern[1:], segments[1:])
+	}
+}
+
+func segmentsNonEmpty(segments []string) bool {
+	for _, segment := range segments {
+		if segment == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns method in upper case if it is a standard HTTP method, or OTHER if not, so it is safe to use as a metric label.
+func Method(method string) string {
+	method = strings.ToUpper(method)
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return OTHER
+}
@@ -0,0 +1,65 @@
+package dockerapi
+
+import "testing"
+
+func TestOperation(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		uri       string
+		operation string
+	}{
+		{name: "versioned", method: "GET", uri: "/v1.43/containers/json", operation: "containers/list"},
+		{name: "unversioned", method: "GET", uri: "/containers/json", operation: "containers/list"},
+		{name: "major version only", method: "GET", uri: "/v1/containers/json", operation: "containers/list"},
+		{name: "query string", method: "POST", uri: "/v1.43/containers/create?name=web", operation: "containers/create"},
+		{name: "lower case method", method: "post", uri: "/v1.43/containers/create", operation: "containers/create"},
+		{name: "ping", method: "HEAD", uri: "/_ping", operation: "system/ping"},
+		{name: "container id", method: "POST", uri: "/v1.43/containers/4fa6e0f0c678/start", operation: "containers/start"},
+		{name: "delete container", method: "DELETE", uri: "/v1.43/containers/4fa6e0f0c678?force=true", operation: "containers/delete"},
+		{name: "exec create", method: "POST", uri: "/v1.43/containers/4fa6e0f0c678/exec", operation: "exec/create"},
+		{name: "exec start", method: "POST", uri: "/v1.43/exec/b1c2d3/start", operation: "exec/start"},
+		{name: "images list is not an image called json", method: "GET", uri: "/v1.43/images/json", operation: "images/list"},
+		{name: "image name", method: "GET", uri: "/v1.43/images/ubuntu:22.04/json", operation: "images/inspect"},
+		{name: "image name with slashes", method: "POST", uri: "/v1.43/images/registry.example.com:5000/team/app/push?tag=1", operation: "images/push"},
+		{name: "escaped image name", method: "GET", uri: "/v1.43/images/library%2Fubuntu/history", operation: "images/history"},
+		{name: "delete image with slashes", method: "DELETE", uri: "/v1.43/images/library/ubuntu", operation: "images/delete"},
+		{name: "pull", method: "POST", uri: "/v1.43/images/create?fromImage=ubuntu&tag=latest", operation: "images/pull"},
+		{name: "plugin name with slashes", method: "POST", uri: "/v1.43/plugins/vieux/sshfs:latest/enable", operation: "plugins/enable"},
+		{name: "wrong method", method: "GET", uri: "/v1.43/containers/create", operation: OTHER},
+		{name: "empty container id", method: "GET", uri: "/v1.43/containers//json", operation: OTHER},
+		{name: "unknown path", method: "GET", uri: "/v1.43/no/such/endpoint", operation: OTHER},
+		{name: "unknown resource action", method: "POST", uri: "/v1.43/containers/4fa6e0f0c678/explode", operation: OTHER},
+		{name: "not the docker api", method: "GET", uri: "/", operation: OTHER},
+		{name: "version only", method: "GET", uri: "/v1.43/", operation: OTHER},
+		{name: "unparseable", method: "GET", uri: "%zz", operation: OTHER},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if operation := Operation(test.method, test.uri); operation != test.operation {
+				t.Fatalf("expected %q, got %q", test.operation, operation)
+			}
+		})
+	}
+}
+
+func TestMethod(t *testing.T) {
+	tests := []struct {
+		method   string
+		expected string
+	}{
+		{method: "GET", expected: "GET"},
+		{method: "delete", expected: "DELETE"},
+		{method: "BREW", expected: OTHER},
+		{method: "", expected: OTHER},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			if method := Method(test.method); method != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, method)
+			}
+		})
+	}
+}
@@ -2,26 +2,59 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/mjec/docker-socket-authorizer/config"
-	"github.com/open-policy-agent/opa/ast"
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/storage"
 	"github.com/open-policy-agent/opa/storage/inmem"
 	"github.com/open-policy-agent/opa/topdown"
-	"github.com/open-policy-agent/opa/types"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 )
 
+// Why loading policies failed, as used in the docker_sock_authorizer_policy_load_failures metric
+const (
+	POLICY_LOAD_FAILURE_PARSE       = "parse"
+	POLICY_LOAD_FAILURE_META_POLICY = "meta_policy"
+	POLICY_LOAD_FAILURE_OTHER       = "other"
+)
+
+var POLICY_LOAD_FAILURE_REASONS = []string{POLICY_LOAD_FAILURE_PARSE, POLICY_LOAD_FAILURE_META_POLICY, POLICY_LOAD_FAILURE_OTHER}
+
+// An error loading policies, with the reason it failed
+type PolicyLoadError struct {
+	Reason string
+	Err    error
+}
+
+func (e *PolicyLoadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PolicyLoadError) Unwrap() error {
+	return e.Err
+}
+
 type RegoEvaluator struct {
 	authorizer *rego.PreparedEvalQuery
 	store      *storage.Store
 	policyList []string
+	revision   string
+	// The metric_labels declared by each policy, as a map from policy to metric to label to allowed values
+	metricDeclarations map[string]map[string]map[string][]string
+	owner              *atomic.Pointer[RegoEvaluator] // the pointer through which this evaluator is in use, if any
+	storageSizes       map[string]int                 // serialized size of the data stored for each policy; protected by storageMutex
+	storageMutex       *sync.Mutex
 }
 
 func NewEvaluator(policyLoader func(*rego.Rego)) (*RegoEvaluator, error) {
@@ -44,84 +77,29 @@ func NewEvaluator(policyLoader func(*rego.Rego)) (*RegoEvaluator, error) {
 		}
 	}()
 
-	function_dns_a := rego.Function1(
-		&rego.Function{
-			Name:             "dns.a",
-			Decl:             types.NewFunction(types.Args(types.S), types.NewArray(make([]types.Type, 0), types.S)),
-			Memoize:          true,
-			Nondeterministic: true,
-		},
-		func(_ rego.BuiltinContext, nameArgument *ast.Term) (*ast.Term, error) {
-			var name string
-			if err := ast.As(nameArgument.Value, &name); err != nil {
-				return nil, fmt.Errorf("dns.a: invalid argument (string required): %s", err)
-			}
-
-			forwardIps, err := net.LookupHost(name)
-			if err != nil {
-				return nil, fmt.Errorf("dns.a: error: %s", err)
-			}
-
-			ipTerms := make([]*ast.Term, len(forwardIps))
-			for i, name := range forwardIps {
-				ipTerms[i] = ast.StringTerm(name)
-			}
-
-			return ast.ArrayTerm(ipTerms...), nil
-		},
-	)
-	function_dns_ptr := rego.Function1(
-		&rego.Function{
-			Name:             "dns.ptr",
-			Decl:             types.NewFunction(types.Args(types.S), types.NewArray(make([]types.Type, 0), types.S)),
-			Memoize:          true,
-			Nondeterministic: true,
-		},
-		func(_ rego.BuiltinContext, ipArgument *ast.Term) (*ast.Term, error) {
-			var ip string
-			if err := ast.As(ipArgument.Value, &ip); err != nil {
-				return nil, fmt.Errorf("dns.ptr: invalid argument (string required): %s", err)
-			}
-
-			if ip == "" || ip == "@" {
-				return ast.ArrayTerm(), nil
-			}
-
-			names, err := net.LookupAddr(ip)
-			if err != nil {
-				return nil, fmt.Errorf("dns.ptr: invalid argument (IP address required): %s", err)
-			}
-
-			nameTerms := make([]*ast.Term, len(names))
-			for i, name := range names {
-				nameTerms[i] = ast.StringTerm(name)
-			}
-
-			return ast.ArrayTerm(nameTerms...), nil
-		},
-	)
-
-	policyMetaRego := rego.New(
-		function_dns_ptr,
-		function_dns_a,
+	// Functions have to be passed to rego.New, as it builds the compiler
+	builtinOptions := customBuiltins()
+
+	policyMetaRego := rego.New(append(
+		builtinOptions,
 		rego.Strict(cfg.Policy.StrictMode),
 		rego.Module("docker_socket_meta_policy", META_POLICY),
 		rego.Query(QUERY),
-	)
+	)...)
 	policyLoader(policyMetaRego)
 	policyMetaQuery, err := policyMetaRego.PrepareForEval(context.Background())
 	if err != nil {
-		return nil, err
+		return nil, &PolicyLoadError{Reason: POLICY_LOAD_FAILURE_PARSE, Err: err}
 	}
 	policyMetaResult, err := policyMetaQuery.Eval(context.Background())
 	if err != nil {
-		return nil, err
+		return nil, &PolicyLoadError{Reason: POLICY_LOAD_FAILURE_META_POLICY, Err: err}
 	}
 	if !policyMetaResult[0].Bindings["meta_policy_ok"].(bool) {
 		if prettyOutput, err := json.Marshal(policyMetaResult[0].Bindings); err != nil {
-			return nil, fmt.Errorf("meta-policy validation failed and unable to serialize output to JSON (%s): %v", err, policyMetaResult[0].Bindings)
+			return nil, &PolicyLoadError{Reason: POLICY_LOAD_FAILURE_META_POLICY, Err: fmt.Errorf("meta-policy validation failed and unable to serialize output to JSON (%s): %v", err, policyMetaResult[0].Bindings)}
 		} else {
-			return nil, fmt.Errorf("meta-policy validation failed: %s", prettyOutput)
+			return nil, &PolicyLoadError{Reason: POLICY_LOAD_FAILURE_META_POLICY, Err: fmt.Errorf("meta-policy validation failed: %s", prettyOutput)}
 		}
 	}
 	policyList := make([]string, 0, len(policyMetaResult[0].Bindings["all_policies"].([]interface{})))
@@ -133,6 +111,12 @@ func NewEvaluator(policyLoader func(*rego.Rego)) (*RegoEvaluator, error) {
 			return nil, fmt.Errorf("invalid policy name of type %T (%v) in all_policies list returned by meta-policy; likely a bug", value, value)
 		}
 	}
+	metricDeclarations := map[string]map[string]map[string][]string{}
+	if serialized, err := json.Marshal(policyMetaResult[0].Bindings["metric_declarations"]); err != nil {
+		return nil, fmt.Errorf("unable to serialize metric_declarations returned by meta-policy; likely a bug: %w", err)
+	} else if err := json.Unmarshal(serialized, &metricDeclarations); err != nil {
+		return nil, fmt.Errorf("invalid metric_declarations returned by meta-policy; likely a bug: %w", err)
+	}
 	for _, policy := range policyList {
 		path, ok := storage.ParsePath("/docker_socket_authorizer_storage/" + policy)
 		if !ok {
@@ -141,15 +125,14 @@ func NewEvaluator(policyLoader func(*rego.Rego)) (*RegoEvaluator, error) {
 		store.Write(context.Background(), transaction, storage.AddOp, path, map[string]interface{}{})
 	}
 
-	newRegoObject := rego.New(
-		function_dns_ptr,
-		function_dns_a,
+	newRegoObject := rego.New(append(
+		builtinOptions,
 		rego.Strict(cfg.Policy.StrictMode),
 		rego.Store(store),
 		rego.Transaction(transaction),
 		rego.Module("docker_socket_meta_policy", META_POLICY),
 		rego.Query(QUERY),
-	)
+	)...)
 
 	var printTo io.Writer = os.Stdout
 	switch cfg.Policy.PrintTo {
@@ -172,7 +155,7 @@ func NewEvaluator(policyLoader func(*rego.Rego)) (*RegoEvaluator, error) {
 
 	query, err := newRegoObject.PrepareForEval(context.Background())
 	if err != nil {
-		return nil, err
+		return nil, &PolicyLoadError{Reason: POLICY_LOAD_FAILURE_PARSE, Err: err}
 	}
 
 	if err := store.Commit(context.Background(), transaction); err != nil {
@@ -180,13 +163,35 @@ func NewEvaluator(policyLoader func(*rego.Rego)) (*RegoEvaluator, error) {
 	}
 	transactionIsCommitted = true
 
+	// The revision identifies the loaded policies by content, so identical policy files always produce the same revision
+	revisionHash := sha256.New()
+	moduleNames := maps.Keys(query.Modules())
+	slices.Sort(moduleNames)
+	for _, name := range moduleNames {
+		fmt.Fprintf(revisionHash, "%s\n%s\n", name, query.Modules()[name].String())
+	}
+
+	storageSizes := make(map[string]int, len(policyList))
+	for _, policy := range policyList {
+		storageSizes[policy] = 2 // len("{}")
+	}
+
 	return &RegoEvaluator{
-		authorizer: &query,
-		store:      &store,
-		policyList: policyList,
+		authorizer:         &query,
+		store:              &store,
+		policyList:         policyList,
+		revision:           hex.EncodeToString(revisionHash.Sum(nil)),
+		metricDeclarations: metricDeclarations,
+		storageSizes:       storageSizes,
+		storageMutex:       &sync.Mutex{},
 	}, nil
 }
 
+// Returns a hash of the content of all loaded modules, which changes if and only if the loaded policies change.
+func (r *RegoEvaluator) Revision() string {
+	return r.revision
+}
+
 func (r *RegoEvaluator) EvaluateQuery(ctx context.Context, options ...rego.EvalOption) (rego.ResultSet, error) {
 	return r.authorizer.Eval(ctx, options...)
 }
@@ -218,14 +223,93 @@ func (r *RegoEvaluator) WriteToStorage(ctx context.Context, toStore map[string]i
 		}
 	}
 
+	sizes, err := serializedSizes(toStore)
+	if err != nil {
+		return err
+	}
+
+	// We hold storageMutex across the commit so that storageSizes always reflects the order in which writes landed
+	r.storageMutex.Lock()
+	defer r.storageMutex.Unlock()
+
 	if err := (*r.store).Commit(ctx, transaction); err != nil {
 		return err
 	}
 	transactionIsCommitted = true
 
+	for policy, size := range sizes {
+		r.storageSizes[policy] = size
+		if r.reportsMetrics() {
+			o11y.Metrics.StorageBytes.WithLabelValues(policy).Set(float64(size))
+		}
+	}
+
 	return nil
 }
 
+// Returns a map from policy name to a description of the storage quota that would be exceeded by writing toStore, for
+// each policy whose data breaches storage.max_bytes_per_policy or would take the total size of stored data over
+// storage.max_total_bytes. Policies are considered in name order, so the total is consumed deterministically.
+// This is advisory: concurrent writes may mean the total is briefly exceeded.
+func (r *RegoEvaluator) StorageQuotaViolations(toStore map[string]interface{}) (map[string]string, error) {
+	cfg := config.ConfigurationPointer.Load()
+	violations := map[string]string{}
+	if cfg.Storage.MaxBytesPerPolicy <= 0 && cfg.Storage.MaxTotalBytes <= 0 {
+		return violations, nil
+	}
+
+	sizes, err := serializedSizes(toStore)
+	if err != nil {
+		return nil, err
+	}
+
+	r.storageMutex.Lock()
+	total := 0
+	for _, size := range r.storageSizes {
+		total += size
+	}
+	previousSizes := make(map[string]int, len(sizes))
+	for policy := range sizes {
+		previousSizes[policy] = r.storageSizes[policy]
+	}
+	r.storageMutex.Unlock()
+
+	policies := maps.Keys(sizes)
+	slices.Sort(policies)
+	for _, policy := range policies {
+		size := sizes[policy]
+		newTotal := total - previousSizes[policy] + size
+		if cfg.Storage.MaxBytesPerPolicy > 0 && size > cfg.Storage.MaxBytesPerPolicy {
+			violations[policy] = fmt.Sprintf("%d bytes exceeds storage.max_bytes_per_policy (%d bytes)", size, cfg.Storage.MaxBytesPerPolicy)
+		} else if cfg.Storage.MaxTotalBytes > 0 && newTotal > cfg.Storage.MaxTotalBytes {
+			violations[policy] = fmt.Sprintf("%d bytes would take total storage to %d bytes, exceeding storage.max_total_bytes (%d bytes)", size, newTotal, cfg.Storage.MaxTotalBytes)
+		} else {
+			total = newTotal
+		}
+	}
+
+	return violations, nil
+}
+
+func serializedSizes(toStore map[string]interface{}) (map[string]int, error) {
+	sizes := make(map[string]int, len(toStore))
+	for policy, value := range toStore {
+		serialized, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to serialize data to store for policy %s: %w", policy, err)
+		}
+		sizes[policy] = len(serialized)
+	}
+	return sizes, nil
+}
+
+// An evaluator is stale if it is not (or is no longer) in use via its owner; evaluators without an owner are always
+// stale, so never write to storage.
 func (r *RegoEvaluator) isStale() bool {
-	return Evaluator.Load() != r
+	return r.owner == nil || r.owner.Load() != r
+}
+
+// Only the evaluator making real decisions reports per-policy metrics, so shadow policies don't pollute them.
+func (r *RegoEvaluator) reportsMetrics() bool {
+	return r.owner == &Evaluator
 }
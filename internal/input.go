@@ -1,16 +1,33 @@
 package internal
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"io"
 	"net/http"
 	"strings"
 )
 
 type request struct {
-	Uri        string      `json:"uri"`
-	RemoteAddr string      `json:"remote_addr"`
-	Headers    http.Header `json:"headers"`
-	Body       string      `json:"body"`
+	Uri               string             `json:"uri"`
+	RemoteAddr        string             `json:"remote_addr"`
+	Headers           http.Header        `json:"headers"`
+	Body              string             `json:"body"`
+	ClientCertificate *clientCertificate `json:"client_certificate"`
+}
+
+// The verified certificate presented by the client, if the listener uses TLS with a client CA
+type clientCertificate struct {
+	Subject           string   `json:"subject"`
+	CommonName        string   `json:"common_name"`
+	Issuer            string   `json:"issuer"`
+	SerialNumber      string   `json:"serial_number"`
+	DnsNames          []string `json:"dns_names"`
+	EmailAddresses    []string `json:"email_addresses"`
+	IpAddresses       []string `json:"ip_addresses"`
+	Uris              []string `json:"uris"`
+	FingerprintSha256 string   `json:"fingerprint_sha256"`
 }
 
 type Input struct {
@@ -30,10 +47,40 @@ func MakeInput(r *http.Request) (Input, error) {
 
 	return Input{
 		request{
-			Uri:        r.RequestURI,
-			RemoteAddr: r.RemoteAddr,
-			Headers:    lowerHeaders,
-			Body:       string(body),
+			Uri:               r.RequestURI,
+			RemoteAddr:        r.RemoteAddr,
+			Headers:           lowerHeaders,
+			Body:              string(body),
+			ClientCertificate: makeClientCertificate(r.TLS),
 		},
 	}, nil
 }
+
+func makeClientCertificate(state *tls.ConnectionState) *clientCertificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	certificate := state.VerifiedChains[0][0]
+
+	ipAddresses := make([]string, 0, len(certificate.IPAddresses))
+	for _, ip := range certificate.IPAddresses {
+		ipAddresses = append(ipAddresses, ip.String())
+	}
+	uris := make([]string, 0, len(certificate.URIs))
+	for _, uri := range certificate.URIs {
+		uris = append(uris, uri.String())
+	}
+	fingerprint := sha256.Sum256(certificate.Raw)
+
+	return &clientCertificate{
+		Subject:           certificate.Subject.String(),
+		CommonName:        certificate.Subject.CommonName,
+		Issuer:            certificate.Issuer.String(),
+		SerialNumber:      certificate.SerialNumber.String(),
+		DnsNames:          append([]string{}, certificate.DNSNames...),
+		EmailAddresses:    append([]string{}, certificate.EmailAddresses...),
+		IpAddresses:       ipAddresses,
+		Uris:              uris,
+		FingerprintSha256: hex.EncodeToString(fingerprint[:]),
+	}
+}
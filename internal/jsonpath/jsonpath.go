@@ -0,0 +1,204 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A path into a JSON document, as a list of object keys or array indexes. Each segment is a glob pattern, using the
+// syntax of path.Match, so (for example) a segment of "*" matches every key or index at that level and "x-original-*"
+// matches every key starting with "x-original-".
+type Path []string
+
+// Parses either a dotted path (e.g. "input.request.headers.authorization") or a JSON pointer (e.g.
+// "/input/request/headers/authorization"; see RFC 6901). Dotted paths cannot address keys containing a ".", for which
+// a JSON pointer must be used instead.
+func Parse(s string) (Path, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+	if strings.HasPrefix(s, "/") {
+		segments := strings.Split(s[1:], "/")
+		for i, segment := range segments {
+			segments[i] = strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~")
+		}
+		return validate(Path(segments))
+	}
+	segments := strings.Split(s, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("empty segment in path %q", s)
+		}
+	}
+	return validate(Path(segments))
+}
+
+func validate(p Path) (Path, error) {
+	for _, segment := range p {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", segment, err)
+		}
+	}
+	return p, nil
+}
+
+// Parses each of paths, returning an error describing every path that could not be parsed.
+func ParseAll(paths []string) ([]Path, error) {
+	parsed := make([]Path, 0, len(paths))
+	var errs []string
+	for _, s := range paths {
+		p, err := Parse(s)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %s", s, err))
+			continue
+		}
+		parsed = append(parsed, p)
+	}
+	if len(errs) > 0 {
+		return parsed, fmt.Errorf("invalid paths: %s", strings.Join(errs, "; "))
+	}
+	return parsed, nil
+}
+
+// Returns the path as a JSON pointer.
+func (p Path) String() string {
+	var b strings.Builder
+	for _, segment := range p {
+		b.WriteByte('/')
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(segment, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+func (p Path) matchesSegment(i int, key string) bool {
+	if p[i] == key {
+		return true
+	}
+	matched, err := path.Match(p[i], key)
+	return err == nil && matched
+}
+
+// Converts value to the form produced by json.Unmarshal into an interface{} (i.e. made up of map[string]interface{},
+// []interface{}, string, float64, bool and nil), which is the form every other function in this package operates on.
+func ToJSONValue(value interface{}) (interface{}, error) {
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var output interface{}
+	if err := json.Unmarshal(serialized, &output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// Calls replace for every value in document matched by p, in place. If replace returns false the matched value is
+// removed from its containing object (or set to nil, in an array); otherwise it is replaced by the returned value.
+// Returns the concrete paths of every value that was matched.
+func (p Path) Replace(document interface{}, replace func(interface{}) (interface{}, bool)) []Path {
+	return p.replace(document, 0, Path{}, replace)
+}
+
+func (p Path) replace(node interface{}, depth int, prefix Path, replace func(interface{}) (interface{}, bool)) []Path {
+	if depth >= len(p) {
+		return nil
+	}
+	var matched []Path
+	last := depth == len(p)-1
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if !p.matchesSegment(depth, key) {
+				continue
+			}
+			childPath := append(append(Path{}, prefix...), key)
+			if !last {
+				matched = append(matched, p.replace(child, depth+1, childPath, replace)...)
+				continue
+			}
+			if newValue, keep := replace(child); keep {
+				node[key] = newValue
+			} else {
+				delete(node, key)
+			}
+			matched = append(matched, childPath)
+		}
+	case []interface{}:
+		for i, child := range node {
+			index := strconv.Itoa(i)
+			if !p.matchesSegment(depth, index) {
+				continue
+			}
+			childPath := append(append(Path{}, prefix...), index)
+			if !last {
+				matched = append(matched, p.replace(child, depth+1, childPath, replace)...)
+				continue
+			}
+			if newValue, keep := replace(child); keep {
+				node[i] = newValue
+			} else {
+				node[i] = nil
+			}
+			matched = append(matched, childPath)
+		}
+	}
+	return matched
+}
+
+// Returns a copy of document containing only the values matched by any of paths, along with the objects and arrays
+// that contain them. Arrays are filtered to only the matched elements, so indexes are not preserved. Returns nil if
+// nothing matched.
+func Select(document interface{}, paths []Path) interface{} {
+	selected, ok := selectPaths(document, paths, 0)
+	if !ok {
+		return nil
+	}
+	return selected
+}
+
+func selectPaths(node interface{}, paths []Path, depth int) (interface{}, bool) {
+	if len(paths) == 0 {
+		// Nothing below here can be selected, so there's no need to walk it
+		return nil, false
+	}
+	for _, p := range paths {
+		if len(p) == depth {
+			// This node is wholly selected by p; everything below it comes along
+			return node, true
+		}
+	}
+
+	switch node := node.(type) {
+	case map[string]interface{}:
+		output := map[string]interface{}{}
+		for key, child := range node {
+			if childSelected, ok := selectPaths(child, matchingPaths(paths, depth, key), depth+1); ok {
+				output[key] = childSelected
+			}
+		}
+		return output, len(output) > 0
+	case []interface{}:
+		output := []interface{}{}
+		for i, child := range node {
+			if childSelected, ok := selectPaths(child, matchingPaths(paths, depth, strconv.Itoa(i)), depth+1); ok {
+				output = append(output, childSelected)
+			}
+		}
+		return output, len(output) > 0
+	}
+	return nil, false
+}
+
+// Returns the subset of paths whose segment at depth matches key
+func matchingPaths(paths []Path, depth int, key string) []Path {
+	output := make([]Path, 0, len(paths))
+	for _, p := range paths {
+		if len(p) > depth && p.matchesSegment(depth, key) {
+			output = append(output, p)
+		}
+	}
+	return output
+}
@@ -0,0 +1,218 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		expected    Path
+		errContains string
+	}{
+		{name: "dotted", path: "input.request.headers", expected: Path{"input", "request", "headers"}},
+		{name: "pointer", path: "/input/request/headers", expected: Path{"input", "request", "headers"}},
+		{name: "pointer with escaped slash", path: "/input/a~1b", expected: Path{"input", "a/b"}},
+		{name: "pointer with escaped tilde", path: "/input/a~0b", expected: Path{"input", "a~b"}},
+		{name: "pointer with escaped tilde before 1", path: "/input/a~01", expected: Path{"input", "a~1"}},
+		{name: "pointer with dot", path: "/input/a.b", expected: Path{"input", "a.b"}},
+		{name: "glob", path: "input.request.headers.x-original-*", expected: Path{"input", "request", "headers", "x-original-*"}},
+		{name: "empty", path: "", errContains: "empty path"},
+		{name: "empty dotted segment", path: "input..request", errContains: "empty segment"},
+		{name: "invalid pattern", path: "input.[", errContains: "invalid pattern"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := Parse(test.path)
+			if test.errContains != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errContains) {
+					t.Fatalf("expected error containing %q, got %v and error %v", test.errContains, parsed, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected %v, got error %v", test.expected, err)
+			}
+			if !reflect.DeepEqual(parsed, test.expected) {
+				t.Fatalf("expected %#v, got %#v", test.expected, parsed)
+			}
+			if !strings.HasPrefix(test.path, "/") {
+				return
+			}
+			if parsed.String() != test.path {
+				t.Fatalf("expected String() to round trip to %q, got %q", test.path, parsed.String())
+			}
+		})
+	}
+}
+
+func TestReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		document string
+		keep     bool
+		expected string
+		matched  []string
+	}{
+		{
+			name:     "object key",
+			path:     "/a/b",
+			document: `{"a": {"b": 1, "c": 2}}`,
+			keep:     true,
+			expected: `{"a": {"b": "x", "c": 2}}`,
+			matched:  []string{"/a/b"},
+		},
+		{
+			name:     "escaped key",
+			path:     "/a~1b/c~0d",
+			document: `{"a/b": {"c~d": 1, "c": 2}}`,
+			keep:     false,
+			expected: `{"a/b": {"c": 2}}`,
+			matched:  []string{"/a~1b/c~0d"},
+		},
+		{
+			name:     "glob over array",
+			path:     "items.*.secret",
+			document: `{"items": [{"secret": 1, "name": "a"}, {"name": "b"}, {"secret": 3}]}`,
+			keep:     false,
+			expected: `{"items": [{"name": "a"}, {"name": "b"}, {}]}`,
+			matched:  []string{"/items/0/secret", "/items/2/secret"},
+		},
+		{
+			name:     "array element removed",
+			path:     "items.1",
+			document: `{"items": [1, 2, 3]}`,
+			keep:     false,
+			expected: `{"items": [1, null, 3]}`,
+			matched:  []string{"/items/1"},
+		},
+		{
+			name:     "glob over keys",
+			path:     "headers.x-original-*",
+			document: `{"headers": {"x-original-uri": "/", "x-original-method": "GET", "host": "example"}}`,
+			keep:     true,
+			expected: `{"headers": {"x-original-uri": "x", "x-original-method": "x", "host": "example"}}`,
+			matched:  []string{"/headers/x-original-method", "/headers/x-original-uri"},
+		},
+		{
+			name:     "no match",
+			path:     "a.missing",
+			document: `{"a": {"b": 1}}`,
+			keep:     true,
+			expected: `{"a": {"b": 1}}`,
+			matched:  nil,
+		},
+		{
+			name:     "path through scalar",
+			path:     "a.b.c",
+			document: `{"a": {"b": 1}}`,
+			keep:     true,
+			expected: `{"a": {"b": 1}}`,
+			matched:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := Parse(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			document := unmarshal(t, test.document)
+			matched := p.Replace(document, func(interface{}) (interface{}, bool) { return "x", test.keep })
+
+			if !reflect.DeepEqual(document, unmarshal(t, test.expected)) {
+				t.Fatalf("expected %s, got %v", test.expected, document)
+			}
+			matchedStrings := []string(nil)
+			for _, m := range matched {
+				matchedStrings = append(matchedStrings, m.String())
+			}
+			sort.Strings(matchedStrings)
+			if !reflect.DeepEqual(matchedStrings, test.matched) {
+				t.Fatalf("expected matches %v, got %v", test.matched, matchedStrings)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []string
+		document string
+		expected string
+	}{
+		{
+			name:     "single value",
+			paths:    []string{"a.b"},
+			document: `{"a": {"b": 1, "c": 2}, "d": 3}`,
+			expected: `{"a": {"b": 1}}`,
+		},
+		{
+			name:     "whole subtree",
+			paths:    []string{"a"},
+			document: `{"a": {"b": 1, "c": 2}, "d": 3}`,
+			expected: `{"a": {"b": 1, "c": 2}}`,
+		},
+		{
+			name:     "several paths",
+			paths:    []string{"a.b", "d"},
+			document: `{"a": {"b": 1, "c": 2}, "d": 3}`,
+			expected: `{"a": {"b": 1}, "d": 3}`,
+		},
+		{
+			name:     "glob over array filters elements",
+			paths:    []string{"items.*.name"},
+			document: `{"items": [{"name": "a", "x": 1}, {"x": 2}, {"name": "c"}]}`,
+			expected: `{"items": [{"name": "a"}, {"name": "c"}]}`,
+		},
+		{
+			name:     "escaped key",
+			paths:    []string{"/a~1b"},
+			document: `{"a/b": 1, "a": {"b": 2}}`,
+			expected: `{"a/b": 1}`,
+		},
+		{
+			name:     "nothing matched",
+			paths:    []string{"missing"},
+			document: `{"a": 1}`,
+			expected: `null`,
+		},
+		{
+			name:     "no paths",
+			paths:    []string{},
+			document: `{"a": 1}`,
+			expected: `null`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths, err := ParseAll(test.paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selected := Select(unmarshal(t, test.document), paths)
+			if !reflect.DeepEqual(selected, unmarshal(t, test.expected)) {
+				t.Fatalf("expected %s, got %v", test.expected, selected)
+			}
+		})
+	}
+}
+
+func unmarshal(t *testing.T, document string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
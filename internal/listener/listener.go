@@ -0,0 +1,160 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/systemd"
+	"golang.org/x/exp/slog"
+)
+
+// The values accepted for a listener's tls.min_version
+var TLS_VERSIONS = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Listens on address, or for the "systemd" type uses the socket named address which was passed by systemd socket
+// activation. Uses TLS if the settings returned by tlsSettings have a certificate file. Whether to use TLS is
+// decided once, here; but every other TLS setting is read from the current configuration on each handshake (which is
+// why tlsSettings is a function), and the certificate, key and client CA files are reread whenever they change, so
+// certificates can be renewed without a restart.
+func Listen(listenerType string, address string, tlsSettings func(cfg *config.Configuration) config.ListenerTLS) (net.Listener, error) {
+	settings := tlsSettings(config.ConfigurationPointer.Load())
+	var tlsConfig *tls.Config
+	if settings.CertificateFile != "" {
+		// Check the settings up front, so that a misconfigured listener fails at startup rather than on every handshake
+		files := &tlsFiles{}
+		if _, err := files.config(settings); err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				connectionConfig, err := files.config(tlsSettings(config.ConfigurationPointer.Load()))
+				if err != nil {
+					slog.Error("Unable to configure TLS for connection", slog.String("address", address), slog.Any("error", err))
+				}
+				return connectionConfig, err
+			},
+		}
+	}
+
+	var listener net.Listener
+	var err error
+	if listenerType == "systemd" {
+		listener, err = systemd.Listener(address)
+	} else {
+		listener, err = net.Listen(listenerType, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
+// The certificate and client CA pool for a TLS listener, as most recently read from their files
+type tlsFiles struct {
+	mutex              sync.Mutex
+	certificate        *tls.Certificate
+	certificateVersion []fileVersion
+	clientCas          *x509.CertPool
+	clientCasVersion   []fileVersion
+}
+
+// Identifies the contents of a file, without reading it
+type fileVersion struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func versionOf(paths ...string) ([]fileVersion, error) {
+	versions := make([]fileVersion, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, fileVersion{path: path, modTime: info.ModTime(), size: info.Size()})
+	}
+	return versions, nil
+}
+
+func sameVersion(a []fileVersion, b []fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].path != b[i].path || !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the TLS configuration for settings, rereading the certificate, key and client CA files if they have changed
+func (f *tlsFiles) config(settings config.ListenerTLS) (*tls.Config, error) {
+	minVersion, ok := TLS_VERSIONS[settings.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS min_version %q (must be one of 1.0, 1.1, 1.2 or 1.3)", settings.MinVersion)
+	}
+	if settings.CertificateFile == "" || settings.KeyFile == "" {
+		return nil, fmt.Errorf("TLS requires both certificate_file and key_file")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	version, err := versionOf(settings.CertificateFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read TLS certificate: %w", err)
+	}
+	if f.certificate == nil || !sameVersion(version, f.certificateVersion) {
+		certificate, err := tls.LoadX509KeyPair(settings.CertificateFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS certificate: %w", err)
+		}
+		if f.certificate != nil {
+			slog.Info("Reloaded TLS certificate", slog.String("certificate_file", settings.CertificateFile))
+		}
+		f.certificate, f.certificateVersion = &certificate, version
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   minVersion,
+		Certificates: []tls.Certificate{*f.certificate},
+	}
+
+	if settings.ClientCaFile != "" {
+		version, err := versionOf(settings.ClientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read TLS client CA: %w", err)
+		}
+		if f.clientCas == nil || !sameVersion(version, f.clientCasVersion) {
+			pem, err := os.ReadFile(settings.ClientCaFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read TLS client CA: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in TLS client CA file %s", settings.ClientCaFile)
+			}
+			f.clientCas, f.clientCasVersion = pool, version
+		}
+		tlsConfig.ClientCAs = f.clientCas
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
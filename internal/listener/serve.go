@@ -0,0 +1,102 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"golang.org/x/exp/slog"
+)
+
+// Whether each server started by Serve (by name) is accepting connections, and whether every server has been started
+var servers = struct {
+	mutex    *sync.Mutex
+	serving  map[string]bool
+	starting bool
+}{
+	mutex:    &sync.Mutex{},
+	serving:  map[string]bool{},
+	starting: true,
+}
+
+func setServing(name string, serving bool) {
+	servers.mutex.Lock()
+	defer servers.mutex.Unlock()
+	servers.serving[name] = serving
+}
+
+// Records that every server has been started, so none are missing from ServerStatus
+func FinishedStarting() {
+	servers.mutex.Lock()
+	defer servers.mutex.Unlock()
+	servers.starting = false
+}
+
+// Returns whether each server started by Serve is accepting connections (they stop on shutdown), and whether more
+// servers may yet be started.
+func ServerStatus() (map[string]bool, bool) {
+	servers.mutex.Lock()
+	defer servers.mutex.Unlock()
+	serving := make(map[string]bool, len(servers.serving))
+	for name, ok := range servers.serving {
+		serving[name] = ok
+	}
+	return serving, servers.starting
+}
+
+// Serves requests on listener with server in the background, until shutdown; name identifies the server in logs. The
+// server's timeouts are set from the server section of the configuration. On shutdown, the server stops accepting
+// connections and waits up to server.drain_timeout_seconds for in-flight requests to finish before cutting them off.
+func Serve(name string, listener net.Listener, server *http.Server) {
+	cfg := config.ConfigurationPointer.Load()
+	server.ReadHeaderTimeout = time.Duration(cfg.Server.ReadHeaderTimeoutSeconds) * time.Second
+	server.IdleTimeout = time.Duration(cfg.Server.IdleTimeoutSeconds) * time.Second
+
+	inFlight := &atomic.Int64{}
+	handler := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		handler.ServeHTTP(w, r)
+	})
+
+	drained := shutdown.Draining()
+	defer shutdown.OnShutdown(name, func() {
+		defer drained()
+		setServing(name, false)
+		logger := slog.With(slog.String("server", name))
+		logger.Debug("Draining requests", slog.Int64("in_flight", inFlight.Load()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown.DrainTimeout())
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			// Read before closing, as closing the connections lets their handlers return
+			cutOff := inFlight.Load()
+			server.Close()
+			logger.Warn(
+				"Requests did not finish before server.drain_timeout_seconds; cut them off",
+				slog.Int64("cut_off", cutOff),
+				slog.Any("error", err),
+			)
+			return
+		}
+		logger.Debug("Drained requests")
+	})
+
+	setServing(name, true)
+	go func() {
+		shutdownErr := server.Serve(listener)
+		setServing(name, false)
+		if errors.Is(shutdownErr, http.ErrServerClosed) {
+			// We are already shutting down
+			return
+		}
+		_ = shutdown.Shutdown(name+" error", slog.LevelError, slog.With(slog.Any("error", shutdownErr)))
+	}()
+}
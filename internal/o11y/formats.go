@@ -0,0 +1,150 @@
+package o11y
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"golang.org/x/exp/slog"
+)
+
+// The name we identify ourselves by to syslog and journald
+const SYSLOG_IDENTIFIER = "docker-socket-authorizer"
+
+const DEFAULT_SYSLOG_SOCKET = "/dev/log"
+
+// Returns a handler for log lines, as configured by log.filename and log.format, along with an io.Closer (which may
+// be nil) to close its output.
+func newLogHandler(cfg *config.Configuration, level slog.Level) (slog.Handler, io.Closer, error) {
+	filename := cfg.Log.Filename
+
+	// journald has its own structured format, so log.format doesn't apply
+	if filename == "journald" || strings.HasPrefix(filename, "journald://") {
+		socket := strings.TrimPrefix(strings.TrimPrefix(filename, "journald"), "://")
+		if socket == "" {
+			socket = DEFAULT_JOURNALD_SOCKET
+		}
+		handler, err := newJournaldHandler(socket, level)
+		if err != nil {
+			return nil, nil, err
+		}
+		return handler, handler, nil
+	}
+
+	// Check the format before opening anything, so we don't have to close it again
+	if _, err := newFormattingHandler(cfg.Log.Format, level, nil); err != nil {
+		return nil, nil, err
+	}
+
+	if strings.HasPrefix(filename, "syslog://") {
+		socket := strings.TrimPrefix(filename, "syslog://")
+		if socket == "" {
+			socket = DEFAULT_SYSLOG_SOCKET
+		}
+		sink, err := newSyslogSink(socket)
+		if err != nil {
+			return nil, nil, err
+		}
+		handler, err := newFormattingHandler(cfg.Log.Format, level, sink)
+		return handler, sink.writer, err
+	}
+
+	output, closer, err := openLoggerOutput(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	handler, err := newFormattingHandler(cfg.Log.Format, level, &writerSink{writer: output})
+	return handler, closer, err
+}
+
+// Receives each formatted log line, along with the record it was formatted from
+type lineSink interface {
+	writeLine(record slog.Record, line []byte) error
+}
+
+type writerSink struct {
+	writer io.Writer
+}
+
+func (s *writerSink) writeLine(_ slog.Record, line []byte) error {
+	_, err := s.writer.Write(line)
+	return err
+}
+
+// Formats each record into a complete line using one of slog's built in handlers, then passes it to a lineSink. This
+// means every sink receives exactly one line per record, whatever the format.
+type formattingHandler struct {
+	inner      slog.Handler
+	textPrefix bool
+	// Shared by every handler derived from the same root (with WithAttrs or WithGroup), as they all format into buffer
+	mutex  *sync.Mutex
+	buffer *bytes.Buffer
+	sink   lineSink
+}
+
+// Returns a handler for format, which may be:
+// - "json" (or empty): a JSON object per line
+// - "logfmt": key=value pairs
+// - "text": a human readable line, starting with the time, level and message, followed by key=value pairs
+func newFormattingHandler(format string, level slog.Level, sink lineSink) (*formattingHandler, error) {
+	buffer := &bytes.Buffer{}
+	h := &formattingHandler{mutex: &sync.Mutex{}, buffer: buffer, sink: sink}
+	switch format {
+	case "json", "":
+		h.inner = slog.NewJSONHandler(buffer, &slog.HandlerOptions{Level: level})
+	case "logfmt":
+		h.inner = slog.NewTextHandler(buffer, &slog.HandlerOptions{Level: level})
+	case "text":
+		h.textPrefix = true
+		h.inner = slog.NewTextHandler(buffer, &slog.HandlerOptions{
+			Level: level,
+			// These are written in the prefix instead
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})
+	default:
+		return nil, fmt.Errorf("unsupported log.format %q; must be one of \"json\", \"logfmt\" or \"text\"", format)
+	}
+	return h, nil
+}
+
+func (h *formattingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *formattingHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.buffer.Reset()
+	if err := h.inner.Handle(ctx, record); err != nil {
+		return err
+	}
+	if !h.textPrefix {
+		return h.sink.writeLine(record, h.buffer.Bytes())
+	}
+
+	line := fmt.Appendf(nil, "%s %-5s %s", record.Time.Format("2006-01-02T15:04:05.000Z07:00"), record.Level.String(), record.Message)
+	attributes := h.buffer.Bytes()
+	// The inner handler always writes a newline, even if there are no attributes
+	if len(attributes) > 1 {
+		line = append(line, ' ')
+	}
+	return h.sink.writeLine(record, append(line, attributes...))
+}
+
+func (h *formattingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &formattingHandler{inner: h.inner.WithAttrs(attrs), textPrefix: h.textPrefix, mutex: h.mutex, buffer: h.buffer, sink: h.sink}
+}
+
+func (h *formattingHandler) WithGroup(name string) slog.Handler {
+	return &formattingHandler{inner: h.inner.WithGroup(name), textPrefix: h.textPrefix, mutex: h.mutex, buffer: h.buffer, sink: h.sink}
+}
@@ -0,0 +1,176 @@
+package o11y
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const DEFAULT_JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
+// journald silently drops fields with longer names
+const JOURNALD_MAX_FIELD_NAME_LENGTH = 64
+
+// Sends records to journald using its native protocol (see systemd.journal-fields(7) and
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/), so every attribute becomes a field of its own: for example, the
+// decision_id attribute becomes a DECISION_ID field. Attributes in groups are prefixed with the group name and an
+// underscore, and values such as objects and lists are encoded as JSON.
+type journaldHandler struct {
+	connection *net.UnixConn
+	level      slog.Level
+	// Fields from WithAttrs, already encoded
+	fields []byte
+	// The field name prefix from WithGroup
+	prefix string
+}
+
+func newJournaldHandler(socket string, level slog.Level) (*journaldHandler, error) {
+	connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldHandler{connection: connection, level: level}, nil
+}
+
+func (h *journaldHandler) Close() error {
+	return h.connection.Close()
+}
+
+func (h *journaldHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *journaldHandler) Handle(_ context.Context, record slog.Record) error {
+	var message bytes.Buffer
+	appendJournaldField(&message, "MESSAGE", record.Message)
+	appendJournaldField(&message, "PRIORITY", strconv.Itoa(journaldPriority(record.Level)))
+	appendJournaldField(&message, "SYSLOG_IDENTIFIER", SYSLOG_IDENTIFIER)
+	if !record.Time.IsZero() {
+		appendJournaldField(&message, "SYSLOG_TIMESTAMP", record.Time.Format(time.RFC3339Nano))
+	}
+	headerLength := message.Len()
+	message.Write(h.fields)
+	record.Attrs(func(a slog.Attr) bool {
+		appendJournaldAttr(&message, h.prefix, a)
+		return true
+	})
+
+	_, err := h.connection.Write(message.Bytes())
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		// Too big for a datagram; send what we can rather than nothing
+		message.Truncate(headerLength)
+		appendJournaldField(&message, "ATTRIBUTES_DROPPED", "record too large for journald datagram")
+		_, err = h.connection.Write(message.Bytes())
+	}
+	return err
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := bytes.NewBuffer(append([]byte{}, h.fields...))
+	for _, a := range attrs {
+		appendJournaldAttr(fields, h.prefix, a)
+	}
+	return &journaldHandler{connection: h.connection, level: h.level, fields: fields.Bytes(), prefix: h.prefix}
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &journaldHandler{connection: h.connection, level: h.level, fields: h.fields, prefix: h.prefix + name + "_"}
+}
+
+func appendJournaldAttr(buffer *bytes.Buffer, prefix string, a slog.Attr) {
+	value := a.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix += a.Key + "_"
+		}
+		for _, groupAttr := range value.Group() {
+			appendJournaldAttr(buffer, groupPrefix, groupAttr)
+		}
+		return
+	}
+	if a.Key == "" {
+		return
+	}
+
+	var encoded string
+	switch value.Kind() {
+	case slog.KindAny:
+		switch v := value.Any().(type) {
+		case error:
+			encoded = v.Error()
+		case string:
+			encoded = v
+		default:
+			serialized, err := json.Marshal(v)
+			if err != nil {
+				encoded = value.String()
+			} else {
+				encoded = string(serialized)
+			}
+		}
+	case slog.KindTime:
+		encoded = value.Time().Format(time.RFC3339Nano)
+	default:
+		encoded = value.String()
+	}
+	appendJournaldField(buffer, journaldFieldName(prefix+a.Key), encoded)
+}
+
+// Appends a field in the native protocol's binary-safe form, which works for every value (including those containing
+// newlines): the name, a newline, the length of the value as a little-endian uint64, the value, and a newline.
+func appendJournaldField(buffer *bytes.Buffer, name string, value string) {
+	buffer.WriteString(name)
+	buffer.WriteByte('\n')
+	_ = binary.Write(buffer, binary.LittleEndian, uint64(len(value)))
+	buffer.WriteString(value)
+	buffer.WriteByte('\n')
+}
+
+// Converts a key to a valid journald field name, which may only contain uppercase letters, digits and underscores,
+// must not start with a digit, and must not start with an underscore (which is reserved for trusted fields).
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'):
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	if name == "" || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		name = "X" + name
+	}
+	if len(name) > JOURNALD_MAX_FIELD_NAME_LENGTH {
+		name = name[:JOURNALD_MAX_FIELD_NAME_LENGTH]
+	}
+	return name
+}
+
+// Maps levels to syslog priorities, as used by journald
+func journaldPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
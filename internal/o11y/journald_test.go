@@ -0,0 +1,162 @@
+//go:build linux
+
+package o11y
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"golang.org/x/exp/slog"
+)
+
+func TestJournaldHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		level slog.Level
+		log   func(logger *slog.Logger)
+		// Fields expected in the datagram; SYSLOG_TIMESTAMP is checked separately, as it varies
+		expected map[string]string
+	}{
+		{
+			name:  "message and priority",
+			level: slog.LevelInfo,
+			log:   func(logger *slog.Logger) { logger.Warn("something happened") },
+			expected: map[string]string{
+				"MESSAGE":           "something happened",
+				"PRIORITY":          "4",
+				"SYSLOG_IDENTIFIER": SYSLOG_IDENTIFIER,
+			},
+		},
+		{
+			name:  "attributes become fields",
+			level: slog.LevelDebug,
+			log: func(logger *slog.Logger) {
+				logger.Debug("decision", "decision_id", "abc", "ok", true, "count", 3, "labels", map[string]string{"a": "b"}, "error", errors.New("failed"))
+			},
+			expected: map[string]string{
+				"MESSAGE":           "decision",
+				"PRIORITY":          "7",
+				"SYSLOG_IDENTIFIER": SYSLOG_IDENTIFIER,
+				"DECISION_ID":       "abc",
+				"OK":                "true",
+				"COUNT":             "3",
+				"LABELS":            `{"a":"b"}`,
+				"ERROR":             "failed",
+			},
+		},
+		{
+			name:  "groups and derived attributes are prefixed",
+			level: slog.LevelInfo,
+			log: func(logger *slog.Logger) {
+				logger.With("component", "authorizer").WithGroup("request").Error("denied", "uri", "/v1.43/containers/json", slog.Group("peer", "pid", 42))
+			},
+			expected: map[string]string{
+				"MESSAGE":           "denied",
+				"PRIORITY":          "3",
+				"SYSLOG_IDENTIFIER": SYSLOG_IDENTIFIER,
+				"COMPONENT":         "authorizer",
+				"REQUEST_URI":       "/v1.43/containers/json",
+				"REQUEST_PEER_PID":  "42",
+			},
+		},
+		{
+			name:  "values with newlines and invalid names",
+			level: slog.LevelInfo,
+			log: func(logger *slog.Logger) {
+				logger.Info("two\nlines", "x-original-uri", "/", "_trusted", "no", "1st", "yes")
+			},
+			expected: map[string]string{
+				"MESSAGE":           "two\nlines",
+				"PRIORITY":          "6",
+				"SYSLOG_IDENTIFIER": SYSLOG_IDENTIFIER,
+				"X_ORIGINAL_URI":    "/",
+				"X_TRUSTED":         "no",
+				"X1ST":              "yes",
+			},
+		},
+		{
+			name:  "too large for a datagram",
+			level: slog.LevelInfo,
+			log:   func(logger *slog.Logger) { logger.Info("big", "input", strings.Repeat("x", 4*1024*1024)) },
+			expected: map[string]string{
+				"MESSAGE":            "big",
+				"PRIORITY":           "6",
+				"SYSLOG_IDENTIFIER":  SYSLOG_IDENTIFIER,
+				"ATTRIBUTES_DROPPED": "record too large for journald datagram",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "journal.socket")
+			listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			cfg := config.DefaultConfiguration()
+			cfg.Log.Filename = "journald://" + socket
+			handler, closer, err := newLogHandler(cfg, test.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+			test.log(slog.New(handler))
+
+			datagram := make([]byte, 64*1024)
+			if err := listener.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			n, err := listener.Read(datagram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := parseJournaldFields(t, datagram[:n])
+
+			timestamp, ok := fields["SYSLOG_TIMESTAMP"]
+			if !ok {
+				t.Fatalf("expected a SYSLOG_TIMESTAMP field, got %v", fields)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+				t.Fatalf("unable to parse SYSLOG_TIMESTAMP: %s", err)
+			}
+			delete(fields, "SYSLOG_TIMESTAMP")
+			if !reflect.DeepEqual(fields, test.expected) {
+				t.Fatalf("expected fields %q, got %q", test.expected, fields)
+			}
+		})
+	}
+}
+
+// Parses a datagram in the native protocol, where every field is in the binary-safe form appendJournaldField writes
+func parseJournaldFields(t *testing.T, datagram []byte) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for len(datagram) > 0 {
+		name, rest, found := bytes.Cut(datagram, []byte("\n"))
+		if !found || len(rest) < 8 {
+			t.Fatalf("truncated field in datagram: %q", datagram)
+		}
+		length := binary.LittleEndian.Uint64(rest[:8])
+		rest = rest[8:]
+		if uint64(len(rest)) < length+1 || rest[length] != '\n' {
+			t.Fatalf("field %s has an invalid length %d", name, length)
+		}
+		if _, ok := fields[string(name)]; ok {
+			t.Fatalf("field %s appears more than once", name)
+		}
+		fields[string(name)] = string(rest[:length])
+		datagram = rest[length+1:]
+	}
+	return fields
+}
@@ -31,27 +31,24 @@ func ConfigureLogger() error {
 	var err error = nil
 	var newFileCloser io.Closer = nil
 	lvl := slog.LevelInfo
-	output := os.Stderr
+	var handler slog.Handler = nil
 
 	if cfg == nil {
 		err = combineErrors(err, fmt.Errorf("configuration object not set (likely an error loading config file on startup); proceeding with defaults"))
 	} else {
 		err = combineErrors(err, lvl.UnmarshalText([]byte(cfg.Log.Level)))
-		if cfg.Log.Filename == "stderr" {
-			output = os.Stderr
-		} else if cfg.Log.Filename == "stdout" {
-			output = os.Stdout
-		} else {
-			f, openFileErr := os.OpenFile(cfg.Log.Filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-			err = combineErrors(err, openFileErr)
-			if openFileErr == nil {
-				output = f
-				newFileCloser = f
-			}
+		h, closer, openErr := newLogHandler(cfg, lvl)
+		err = combineErrors(err, openErr)
+		if openErr == nil {
+			handler = h
+			newFileCloser = closer
 		}
 	}
+	if handler == nil {
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})
+	}
 
-	logSettings.logger = slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{Level: lvl}))
+	logSettings.logger = slog.New(handler)
 	if err == nil || !logSettings.configured {
 		slog.SetDefault(logSettings.logger)
 		if logSettings.fileCloser != nil {
@@ -59,11 +56,47 @@ func ConfigureLogger() error {
 		}
 		logSettings.configured = true
 		logSettings.fileCloser = newFileCloser
+	} else if newFileCloser != nil {
+		newFileCloser.Close()
 	}
 
 	return err
 }
 
+// Opens filename for appending log lines, where filename may also be "stderr" or "stdout". The returned io.Closer is
+// nil for stderr and stdout, which should never be closed.
+func OpenLogFile(filename string) (io.Writer, io.Closer, error) {
+	switch filename {
+	case "stderr":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return os.Stdout, nil, nil
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
+
+// Opens log.filename, rotating it in-process if log.rotation is configured.
+func openLoggerOutput(cfg *config.Configuration) (io.Writer, io.Closer, error) {
+	return OpenRotatingLogFile(cfg.Log.Filename, "log.rotation", cfg.Log.Rotation)
+}
+
+// Opens filename as OpenLogFile does, but rotates it in-process if rotation has a maximum size or age (which is
+// ignored for stderr and stdout). settingName is the name of the setting rotation came from, used in errors.
+func OpenRotatingLogFile(filename string, settingName string, rotation config.LogRotation) (io.Writer, io.Closer, error) {
+	if filename == "stderr" || filename == "stdout" || (rotation.MaxBytes == 0 && rotation.MaxAgeSeconds == 0) {
+		return OpenLogFile(filename)
+	}
+	f, err := openRotatingFile(filename, settingName, rotation)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f, nil
+}
+
 func combineErrors(errors ...error) error {
 	var output error
 	for _, err := range errors {
@@ -1,24 +1,41 @@
 package o11y
 
 import (
-	"net"
 	"net/http"
 
 	"github.com/mjec/docker-socket-authorizer/config"
-	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"github.com/mjec/docker-socket-authorizer/internal/listener"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/exp/slog"
 )
 
 var Metrics = struct {
-	Approved             prometheus.Counter
-	Denied               prometheus.Counter
-	Errors               prometheus.Counter
-	PolicyLoads          prometheus.Counter
-	PolicyLoadTimer      prometheus.Histogram
-	PolicyMutexWaitTimer prometheus.Histogram
+	Approved                prometheus.Counter
+	Denied                  prometheus.Counter
+	ApprovedOperations      *prometheus.CounterVec
+	DeniedOperations        *prometheus.CounterVec
+	Errors                  prometheus.Counter
+	PolicyLoads             prometheus.Counter
+	PolicyLoadFailures      *prometheus.CounterVec
+	PolicyLoadFailing       prometheus.Gauge
+	PolicyLastLoadTimestamp prometheus.Gauge
+	PolicyInfo              *prometheus.GaugeVec
+	PoliciesLoaded          prometheus.Gauge
+	PolicyLoadTimer         prometheus.Histogram
+	PolicyMutexWaitTimer    prometheus.Histogram
+	StorageBytes            *prometheus.GaugeVec
+	StorageQuotaBreaches    *prometheus.CounterVec
+	DecisionLogUploads      prometheus.Counter
+	DecisionLogUploadErrors prometheus.Counter
+	DecisionLogDropped      *prometheus.CounterVec
+	DecisionLogBuffered     prometheus.Gauge
+	ShadowEvaluations       *prometheus.CounterVec
+	PolicyResults           *prometheus.CounterVec
+	AuthorizationPhaseTimer *prometheus.HistogramVec
+	BuiltinCalls            *prometheus.CounterVec
+	BuiltinErrors           *prometheus.CounterVec
+	BuiltinTimer            *prometheus.HistogramVec
 }{
 	Approved: promauto.NewCounter(prometheus.CounterOpts{
 		Name: "docker_sock_authorizer_approved",
@@ -28,6 +45,14 @@ var Metrics = struct {
 		Name: "docker_sock_authorizer_denied",
 		Help: "The total number of denied requests",
 	}),
+	ApprovedOperations: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_approved_operations",
+		Help: "The total number of approved requests, by original method and Docker API operation",
+	}, []string{"method", "operation"}),
+	DeniedOperations: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_denied_operations",
+		Help: "The total number of denied requests, by original method and Docker API operation",
+	}, []string{"method", "operation"}),
 	Errors: promauto.NewCounter(prometheus.CounterOpts{
 		Name: "docker_sock_authorizer_errors",
 		Help: "The total number of requests resulting in an internal server error",
@@ -36,6 +61,26 @@ var Metrics = struct {
 		Name: "docker_sock_authorizer_configuration_loads",
 		Help: "The total number of times policies have been (re)loaded",
 	}),
+	PolicyLoadFailures: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_policy_load_failures",
+		Help: "The total number of times policies have failed to (re)load, by reason (parse, meta_policy or other)",
+	}, []string{"reason"}),
+	PolicyLoadFailing: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "docker_sock_authorizer_policy_load_failing",
+		Help: "1 if the most recent attempt to (re)load policies failed, meaning the policies in use are stale; otherwise 0",
+	}),
+	PolicyLastLoadTimestamp: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "docker_sock_authorizer_policy_last_load_timestamp_seconds",
+		Help: "The time policies were last (re)loaded successfully, in seconds since the Unix epoch",
+	}),
+	PolicyInfo: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "docker_sock_authorizer_policy_info",
+		Help: "Always 1, labelled with the revision (a hash of the content) of the policies in use",
+	}, []string{"revision"}),
+	PoliciesLoaded: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "docker_sock_authorizer_policies_loaded",
+		Help: "The number of policies in use",
+	}),
 	PolicyLoadTimer: promauto.NewHistogram(prometheus.HistogramOpts{
 		Name: "docker_sock_authorizer_policy_load_seconds",
 		Help: "The time it takes to load policies for the authorizer",
@@ -44,17 +89,66 @@ var Metrics = struct {
 		Name: "docker_sock_authorizer_policy_mutex_wait_seconds",
 		Help: "The time it takes to acquire the policy mutex; always contained in policy_load time",
 	}),
+	StorageBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "docker_sock_authorizer_storage_bytes",
+		Help: "The serialized size of the data currently stored for each policy",
+	}, []string{"policy"}),
+	StorageQuotaBreaches: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_storage_quota_breaches",
+		Help: "The total number of writes to storage which would have exceeded a storage quota, by policy",
+	}, []string{"policy"}),
+	DecisionLogUploads: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_decision_log_uploads",
+		Help: "The total number of batches of decisions successfully uploaded to decision_log.upload.url",
+	}),
+	DecisionLogUploadErrors: promauto.NewCounter(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_decision_log_upload_errors",
+		Help: "The total number of failed attempts to upload a batch of decisions",
+	}),
+	DecisionLogDropped: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_decision_log_dropped",
+		Help: "The total number of decisions dropped without being uploaded, by reason",
+	}, []string{"reason"}),
+	DecisionLogBuffered: promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "docker_sock_authorizer_decision_log_buffered",
+		Help: "The number of decisions buffered in memory waiting to be uploaded",
+	}),
+	ShadowEvaluations: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_shadow_evaluations",
+		Help: "The total number of requests evaluated against shadow policies, by outcome (agree, disagree, error, timeout or skipped)",
+	}, []string{"outcome"}),
+	PolicyResults: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_policy_results",
+		Help: "The total number of times each policy has produced each result (allow, deny, skip or invalid)",
+	}, []string{"policy", "result"}),
+	AuthorizationPhaseTimer: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "docker_sock_authorizer_authorization_phase_seconds",
+		Help: "The time taken by each phase of handling an authorization request (input, evaluation or storage)",
+	}, []string{"phase"}),
+	BuiltinCalls: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_builtin_calls",
+		Help: "The total number of calls to each function provided to policies by docker-socket-authorizer (e.g. dns.ptr) while authorizing requests",
+	}, []string{"builtin"}),
+	BuiltinErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "docker_sock_authorizer_builtin_errors",
+		Help: "The total number of calls to each function provided to policies which returned an error",
+	}, []string{"builtin"}),
+	BuiltinTimer: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "docker_sock_authorizer_builtin_seconds",
+		Help: "The time taken by each call to each function provided to policies",
+	}, []string{"builtin"}),
 }
 
 func InitializeMetrics(cfg *config.Configuration) error {
 	if cfg.Metrics.Listener.Type != "" && cfg.Metrics.Listener.Type != "none" {
-		metricsListener, err := net.Listen(cfg.Metrics.Listener.Type, cfg.Metrics.Listener.Address)
+		metricsListener, err := listener.Listen(
+			cfg.Metrics.Listener.Type,
+			cfg.Metrics.Listener.Address,
+			func(cfg *config.Configuration) config.ListenerTLS { return cfg.Metrics.Listener.Tls },
+		)
 		if err != nil {
 			return err
 		}
-		defer shutdown.OnShutdown("metrics", func() {
-			metricsListener.Close()
-		})
 
 		metricsMux := http.NewServeMux()
 		metricsMux.HandleFunc(
@@ -68,10 +162,7 @@ func InitializeMetrics(cfg *config.Configuration) error {
 			},
 		)
 
-		go func() {
-			shutdownErr := http.Serve(metricsListener, metricsMux)
-			_ = shutdown.Shutdown("metrics server error", slog.LevelError, slog.With("error", shutdownErr))
-		}()
+		listener.Serve("metrics server", metricsListener, &http.Server{Handler: metricsMux})
 	}
 
 	return nil
@@ -0,0 +1,112 @@
+package o11y
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// Counters declared by policies, keyed by policyCounterName; protected by policyCountersMutex
+var policyCounters = map[string]*policyCounter{}
+var policyCountersMutex = &sync.RWMutex{}
+
+type policyCounter struct {
+	counter *prometheus.CounterVec
+	labels  []string
+}
+
+// Must match metric_full_name in the meta-policy, which rejects declarations whose names would collide
+func policyCounterName(policy string, metric string) string {
+	return "docker_sock_authorizer_policy_metric_" + policy + "_" + metric
+}
+
+// Registers a counter for each metric declared by each policy, as a map from policy to metric to label to allowed
+// values. Counters which are no longer declared (or whose labels have changed) are unregistered, so their values are
+// lost; counters which are unchanged keep their values across reloads. Every allowed combination of label values is
+// initialized to zero, so that they are all visible from the start.
+func RegisterPolicyCounters(declarations map[string]map[string]map[string][]string) {
+	policyCountersMutex.Lock()
+	defer policyCountersMutex.Unlock()
+
+	type declaration struct {
+		help   string
+		labels map[string][]string
+	}
+	wanted := map[string]declaration{}
+	for policy, metrics := range declarations {
+		for metric, labels := range metrics {
+			wanted[policyCounterName(policy, metric)] = declaration{
+				help:   fmt.Sprintf("The %s counter declared by the %s policy", metric, policy),
+				labels: labels,
+			}
+		}
+	}
+
+	for name, existing := range policyCounters {
+		if d, ok := wanted[name]; ok && slices.Equal(existing.labels, sortedKeys(d.labels)) {
+			continue
+		}
+		prometheus.DefaultRegisterer.Unregister(existing.counter)
+		delete(policyCounters, name)
+	}
+
+	for name, d := range wanted {
+		labelNames := sortedKeys(d.labels)
+		existing, ok := policyCounters[name]
+		if !ok {
+			counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: name,
+				Help: d.help,
+			}, labelNames)
+			if err := prometheus.DefaultRegisterer.Register(counter); err != nil {
+				slog.Warn("Unable to register policy metric", slog.String("metric", name), slog.Any("error", err))
+				continue
+			}
+			existing = &policyCounter{counter: counter, labels: labelNames}
+			policyCounters[name] = existing
+		}
+		// Allowed values may have been added since the counter was registered
+		forEachCombination(labelNames, d.labels, map[string]string{}, func(values map[string]string) {
+			existing.counter.With(values)
+		})
+	}
+}
+
+// Increments the counter for metric declared by policy. Counters which were not registered are ignored, as are labels
+// which don't match the declaration; the meta-policy should already have rejected those.
+func IncrementPolicyCounter(policy string, metric string, labels map[string]string) {
+	policyCountersMutex.RLock()
+	defer policyCountersMutex.RUnlock()
+
+	existing, ok := policyCounters[policyCounterName(policy, metric)]
+	if !ok {
+		return
+	}
+	counter, err := existing.counter.GetMetricWith(labels)
+	if err != nil {
+		return
+	}
+	counter.Inc()
+}
+
+func sortedKeys(labels map[string][]string) []string {
+	keys := maps.Keys(labels)
+	slices.Sort(keys)
+	return keys
+}
+
+func forEachCombination(labelNames []string, allowed map[string][]string, values map[string]string, f func(map[string]string)) {
+	if len(labelNames) == 0 {
+		f(maps.Clone(values))
+		return
+	}
+	for _, value := range allowed[labelNames[0]] {
+		values[labelNames[0]] = value
+		forEachCombination(labelNames[1:], allowed, values, f)
+	}
+	delete(values, labelNames[0])
+}
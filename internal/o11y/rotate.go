@@ -0,0 +1,291 @@
+package o11y
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+)
+
+// Rotated files are named after the file being rotated, followed by the time of rotation in this format, so that
+// they sort in the order they were rotated
+const ROTATED_FILE_TIME_FORMAT = "2006-01-02T15-04-05.000000000"
+
+const COMPRESSED_FILE_SUFFIX = ".gz"
+
+// Implemented by the writer OpenRotatingLogFile returns when it rotates in-process, for callers which need to end each
+// file with a record of their own (such as a decision log checkpoint) before it is rotated.
+type Rotator interface {
+	// Reports whether the file would be rotated before a write of writeSize bytes.
+	DueForRotation(writeSize int) bool
+	// Writes trailer to the end of the file, however large that makes it, then rotates it.
+	RotateAfter(trailer []byte) error
+}
+
+// When each rotating file was first opened or last rotated by this process, so that reopening it (for example, on
+// reload) doesn't restart its age
+var startTimes = &sync.Map{}
+
+// A log file which rotates itself once it reaches a maximum size or age. Safe for concurrent writers.
+type rotatingFile struct {
+	mutex      *sync.Mutex
+	filename   string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	// Protected by mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// Serializes compressing and pruning rotated files, which happens in the background
+	cleanupMutex *sync.Mutex
+}
+
+// Opens filename for appending log lines, rotating it according to rotation, which is configured by the setting
+// named settingName (used in errors). Age is measured from when the file was started, which is when it was last rotated
+// if that is known, or otherwise when it was first opened by this process.
+func openRotatingFile(filename string, settingName string, rotation config.LogRotation) (*rotatingFile, error) {
+	if rotation.MaxBytes < 0 || rotation.MaxAgeSeconds < 0 || rotation.MaxBackups < 0 {
+		return nil, fmt.Errorf("%s.max_bytes, max_age_seconds and max_backups must not be negative", settingName)
+	}
+	r := &rotatingFile{
+		mutex:        &sync.Mutex{},
+		filename:     filename,
+		maxBytes:     int64(rotation.MaxBytes),
+		maxAge:       time.Duration(rotation.MaxAgeSeconds) * time.Second,
+		maxBackups:   rotation.MaxBackups,
+		compress:     rotation.Compress,
+		cleanupMutex: &sync.Mutex{},
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.openedAt = r.startTime()
+	startTimes.Store(filename, r.openedAt)
+	return r, nil
+}
+
+// Returns when the current file was started: now if it is empty, otherwise when this process first opened it or last
+// rotated it, or failing that when it was last rotated by another process. Must be called with mutex held.
+func (r *rotatingFile) startTime() time.Time {
+	if r.size == 0 {
+		return time.Now()
+	}
+	if started, ok := startTimes.Load(r.filename); ok {
+		return started.(time.Time)
+	}
+	backups, err := r.rotatedFiles()
+	if err != nil || len(backups) == 0 {
+		return time.Now()
+	}
+	rotatedAt, _ := rotationTime(filepath.Base(r.filename), filepath.Base(backups[len(backups)-1]))
+	return rotatedAt
+}
+
+// Must be called with mutex held
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.shouldRotate(len(p)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to rotate log file %s: %s\n", r.filename, err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) DueForRotation(writeSize int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file != nil && r.shouldRotate(writeSize)
+}
+
+func (r *rotatingFile) RotateAfter(trailer []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return os.ErrClosed
+	}
+	n, err := r.file.Write(trailer)
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return r.rotate()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Must be called with mutex held. We never rotate an empty file, so a single write larger than max_bytes still
+// ends up in a file of its own.
+func (r *rotatingFile) shouldRotate(writeSize int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxBytes > 0 && r.size+int64(writeSize) > r.maxBytes {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.openedAt) >= r.maxAge
+}
+
+// Must be called with mutex held
+func (r *rotatingFile) rotate() error {
+	rotatedName := r.filename + "." + time.Now().UTC().Format(ROTATED_FILE_TIME_FORMAT)
+	if err := os.Rename(r.filename, rotatedName); err != nil {
+		return err
+	}
+	// If we can't open a new file, we keep writing to the rotated one rather than losing log lines
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.openedAt = time.Now()
+	startTimes.Store(r.filename, r.openedAt)
+
+	go r.cleanUp(rotatedName)
+	return nil
+}
+
+// Compresses the newly rotated file (if enabled), then removes the oldest rotated files beyond max_backups. Errors are
+// written to stderr, as logging them would risk writing to the log file we're in the middle of rotating.
+func (r *rotatingFile) cleanUp(rotatedName string) {
+	r.cleanupMutex.Lock()
+	defer r.cleanupMutex.Unlock()
+
+	if r.compress {
+		if err := compressFile(rotatedName); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to compress rotated log file %s: %s\n", rotatedName, err)
+		}
+	}
+
+	if r.maxBackups == 0 {
+		return
+	}
+	backups, err := r.rotatedFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to list rotated log files for %s: %s\n", r.filename, err)
+		return
+	}
+	for len(backups) > r.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to remove old rotated log file %s: %s\n", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// Returns the rotated files for this file, oldest first.
+func (r *rotatingFile) rotatedFiles() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(r.filename))
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		if _, ok := rotationTime(filepath.Base(r.filename), name); !ok {
+			continue
+		}
+		files = append(files, filepath.Join(filepath.Dir(r.filename), name))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return strings.TrimSuffix(files[i], COMPRESSED_FILE_SUFFIX) < strings.TrimSuffix(files[j], COMPRESSED_FILE_SUFFIX)
+	})
+	return files, nil
+}
+
+// Returns the time at which the file named base was rotated to name, or false if name isn't a rotated copy of base.
+func rotationTime(base string, name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, base+".") {
+		return time.Time{}, false
+	}
+	timestamp := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), COMPRESSED_FILE_SUFFIX)
+	rotatedAt, err := time.Parse(ROTATED_FILE_TIME_FORMAT, timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return rotatedAt, true
+}
+
+// Replaces filename with a gzipped copy named filename.gz.
+func compressFile(filename string) error {
+	source, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// Write to a temporary name first, so a partially compressed file is never mistaken for a complete one
+	temporaryName := filename + COMPRESSED_FILE_SUFFIX + ".tmp"
+	destination, err := os.OpenFile(temporaryName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(destination)
+	if _, err := io.Copy(gz, source); err != nil {
+		destination.Close()
+		os.Remove(temporaryName)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		destination.Close()
+		os.Remove(temporaryName)
+		return err
+	}
+	if err := destination.Close(); err != nil {
+		os.Remove(temporaryName)
+		return err
+	}
+	if err := os.Rename(temporaryName, filename+COMPRESSED_FILE_SUFFIX); err != nil {
+		os.Remove(temporaryName)
+		return err
+	}
+	return os.Remove(filename)
+}
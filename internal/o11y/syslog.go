@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+
+package o11y
+
+import (
+	"bytes"
+	"log/syslog"
+
+	"golang.org/x/exp/slog"
+)
+
+func newSyslogSink(socket string) (*syslogSink, error) {
+	writer, err := syslog.Dial("unixgram", socket, syslog.LOG_INFO|syslog.LOG_DAEMON, SYSLOG_IDENTIFIER)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+// Sends each line to syslog at the priority matching its level
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogSink) writeLine(record slog.Record, line []byte) error {
+	message := string(bytes.TrimRight(line, "\n"))
+	switch {
+	case record.Level >= slog.LevelError:
+		return s.writer.Err(message)
+	case record.Level >= slog.LevelWarn:
+		return s.writer.Warning(message)
+	case record.Level >= slog.LevelInfo:
+		return s.writer.Info(message)
+	default:
+		return s.writer.Debug(message)
+	}
+}
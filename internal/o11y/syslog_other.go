@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package o11y
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/exp/slog"
+)
+
+// log/syslog isn't available here, so log.filename can't be a syslog:// URL
+func newSyslogSink(_ string) (*syslogSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+type syslogSink struct {
+	writer io.Closer
+}
+
+func (s *syslogSink) writeLine(_ slog.Record, _ []byte) error {
+	return errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,83 @@
+//go:build !windows && !plan9
+
+package o11y
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"golang.org/x/exp/slog"
+)
+
+func TestSyslogSink(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		log    func(logger *slog.Logger)
+		// The priority is the daemon facility (3) times 8, plus the severity
+		priority int
+		message  string
+	}{
+		{name: "error", log: func(logger *slog.Logger) { logger.Error("failed") }, priority: 27, message: `"msg":"failed"`},
+		{name: "warning", log: func(logger *slog.Logger) { logger.Warn("careful") }, priority: 28, message: `"msg":"careful"`},
+		{name: "info", log: func(logger *slog.Logger) { logger.Info("hello", "decision_id", "abc") }, priority: 30, message: `"decision_id":"abc"`},
+		{name: "debug", log: func(logger *slog.Logger) { logger.Debug("detail") }, priority: 31, message: `"msg":"detail"`},
+		{name: "logfmt", format: "logfmt", log: func(logger *slog.Logger) { logger.Info("hello", "decision_id", "abc") }, priority: 30, message: "msg=hello decision_id=abc"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			socket := filepath.Join(t.TempDir(), "log.socket")
+			listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			cfg := config.DefaultConfiguration()
+			cfg.Log.Filename = "syslog://" + socket
+			if test.format != "" {
+				cfg.Log.Format = test.format
+			}
+			handler, closer, err := newLogHandler(cfg, slog.LevelDebug)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+			test.log(slog.New(handler))
+
+			datagram := make([]byte, 64*1024)
+			if err := listener.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			n, err := listener.Read(datagram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := string(datagram[:n])
+
+			prefix := fmt.Sprintf("<%d>", test.priority)
+			if !strings.HasPrefix(received, prefix) {
+				t.Fatalf("expected a message starting with %q, got %q", prefix, received)
+			}
+			tag := fmt.Sprintf(" %s[%d]: ", SYSLOG_IDENTIFIER, os.Getpid())
+			_, message, found := strings.Cut(received, tag)
+			if !found {
+				t.Fatalf("expected a message tagged %q, got %q", tag, received)
+			}
+			if !strings.Contains(message, test.message) {
+				t.Fatalf("expected a message containing %q, got %q", test.message, message)
+			}
+			// One line per record, without the formatter's trailing newline doubled up
+			if strings.Count(message, "\n") > 1 {
+				t.Fatalf("expected a single line, got %q", message)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package o11y
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+const TRACER_NAME = "github.com/mjec/docker-socket-authorizer"
+
+// Spans are no-ops unless tracing is enabled, as the global tracer provider does nothing until InitializeTracing
+// replaces it.
+var Tracer trace.Tracer = otel.Tracer(TRACER_NAME)
+
+// Starts exporting traces to tracing.endpoint, if tracing is enabled. Incoming W3C trace context (the traceparent and
+// tracestate headers) is accepted whether or not tracing is enabled, so it is never an error to send it.
+func InitializeTracing(cfg *config.Configuration) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if !cfg.Tracing.Enabled {
+		return nil
+	}
+
+	endpoint, err := url.Parse(cfg.Tracing.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid tracing.endpoint: %w", err)
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithURLPath(endpoint.Path),
+		otlptracehttp.WithTimeout(time.Duration(cfg.Tracing.TimeoutSeconds) * time.Second),
+	}
+	switch endpoint.Scheme {
+	case "http":
+		options = append(options, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return fmt.Errorf("unsupported tracing.endpoint scheme %q; must be \"http\" or \"https\"", endpoint.Scheme)
+	}
+
+	sampler, err := newSampler(cfg.Tracing.Sampler, cfg.Tracing.SamplerArg)
+	if err != nil {
+		return err
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return fmt.Errorf("unable to create trace exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.Tracing.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Error exporting traces", slog.Any("error", err))
+	}))
+
+	defer shutdown.OnShutdown("tracing", func() {
+		// Flushes any spans which haven't been exported yet, including those from requests which were draining
+		shutdown.WaitForDrain()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdown.GRACE_SECONDS*float64(time.Second)))
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Warn("Unable to flush traces on shutdown", slog.Any("error", err))
+		}
+	})
+	return nil
+}
+
+// Returns the sampler named by tracing.sampler, which takes the same values as the standard OTEL_TRACES_SAMPLER
+// environment variable; the ratio for the traceidratio samplers is given by tracing.sampler_arg.
+func newSampler(name string, argument string) (sdktrace.Sampler, error) {
+	ratio := func() (float64, error) {
+		value, err := strconv.ParseFloat(argument, 64)
+		if err != nil || value < 0 || value > 1 {
+			return 0, fmt.Errorf("invalid tracing.sampler_arg %q; must be a number between 0 and 1", argument)
+		}
+		return value, nil
+	}
+
+	switch name {
+	case "always_on":
+		return sdktrace.AlwaysSample(), nil
+	case "always_off":
+		return sdktrace.NeverSample(), nil
+	case "traceidratio":
+		value, err := ratio()
+		return sdktrace.TraceIDRatioBased(value), err
+	case "parentbased_always_on":
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	case "parentbased_traceidratio":
+		value, err := ratio()
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(value)), err
+	}
+	return nil, fmt.Errorf("unsupported tracing.sampler %q", name)
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -8,13 +9,18 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/mjec/docker-socket-authorizer/config"
 	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/mjec/docker-socket-authorizer/internal/systemd"
 	"github.com/open-policy-agent/opa/rego"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 )
 
 var (
 	Evaluator           atomic.Pointer[RegoEvaluator] = atomic.Pointer[RegoEvaluator]{}
+	ShadowEvaluator     atomic.Pointer[RegoEvaluator] = atomic.Pointer[RegoEvaluator]{} // nil if there are no shadow policies
 	GlobalPolicyWatcher atomic.Pointer[PolicyWatcher] = atomic.Pointer[PolicyWatcher]{}
+	LastPolicyLoad      atomic.Pointer[PolicyLoad]    = atomic.Pointer[PolicyLoad]{} // nil until policies are first loaded
 	loadPoliciesMutex   *sync.Mutex                   = &sync.Mutex{}
 )
 
@@ -31,6 +37,11 @@ var (
 // - skips: map[string]string, a map from policy to message for each policy with a result of "skip"
 // - invalid_policies: []string, a list of policy names that do not produce a valid `result` and `message`
 // - invalid_storage: []string, a list of policy names that do not produce a valid `to_store` object
+// - metrics: map[string]map[string]map[string]string, a map from policy to the metrics it emitted, for each policy
+// with valid metrics (see META_POLICY)
+// - rejected_metrics: []string, a list of policy names that emit metrics not allowed by their metric_labels (which
+// are dropped, but do not otherwise affect the result)
+// - metric_declarations: map[string]map[string]map[string][]string, a map from policy to its declared metric_labels
 const QUERY = `
 denies = {policy: data.docker_socket_authorizer[policy].message | data.docker_socket_authorizer[policy].result == "deny"}
 allows = {policy: data.docker_socket_authorizer[policy].message | data.docker_socket_authorizer[policy].result == "allow"}
@@ -43,6 +54,13 @@ meta_policy_ok = data.docker_socket_meta_policy.ok
 
 to_store = {policy: data.docker_socket_authorizer[policy].to_store | true}
 
+rejected_metrics = data.docker_socket_meta_policy.rejected_metrics
+metric_declarations = data.docker_socket_meta_policy.metric_declarations
+metrics = {policy: emitted |
+	emitted := data.docker_socket_authorizer[policy].metrics
+	not data.docker_socket_meta_policy.rejected_metrics[policy]
+}
+
 ok_conditions = {
 	"meta-policy passes": meta_policy_ok,
 	"no invalid policies": count(invalid_policies) == 0,
@@ -62,9 +80,16 @@ count({policy | data.docker_socket_authorizer[policy]}) == count(denies) + count
 // all_policies: []string, a list of the names of policies that are loaded under the `docker_socket_authorizer` namespace
 // invalid_policies: []string, a list of policy names that do not produce a valid `result` and `message`
 // invalid_storage: []string, a list of policy names that do not produce a valid `to_store` object
+// invalid_metrics: []string, a list of policy names that declare invalid `metric_labels`
+// rejected_metrics: []string, a list of policy names that emit `metrics` which are not allowed by their
+// `metric_labels`; this does not affect ok, as those metrics are just dropped
+// metric_declarations: map[string]map[string]map[string][]string, a map from policy to its `metric_labels`
 const META_POLICY = `
 package docker_socket_meta_policy
 
+import future.keywords.every
+import future.keywords.in
+
 default ok := false
 
 all_policies = { policy | data.docker_socket_authorizer[policy] }
@@ -88,13 +113,91 @@ invalid_storage = {policy |
 
 invalid_policies = all_policies - ok_policies
 
+# Policies may emit metrics, which are counters, as an object from metric name to an object of labels; but only those
+# declared in metric_labels, an object from metric name to an object from each label name to a list of its allowed
+# values. These limits keep the number of time series bounded.
+max_metrics_per_policy := 10
+max_series_per_metric := 100
+
+metric_declarations = {policy: declaration |
+	declaration := data.docker_socket_authorizer[policy].metric_labels
+	valid_metric_declaration(declaration)
+	not colliding_metric_names[policy]
+}
+
+# Must match policyCounterName in internal/o11y/policymetrics.go. No built in metric starts with this prefix, but
+# policy and metric names can both contain underscores, so different policies could still produce the same name.
+metric_full_name(policy, name) := concat("_", ["docker_sock_authorizer_policy_metric", policy, name])
+
+colliding_metric_names = {policy |
+	some name, _ in data.docker_socket_authorizer[policy].metric_labels
+	some other_policy
+	other_policy != policy
+	some other_name, _ in data.docker_socket_authorizer[other_policy].metric_labels
+	metric_full_name(policy, name) == metric_full_name(other_policy, other_name)
+}
+
+valid_metric_name(name) {
+	regex.match("^[a-z][a-z0-9_]*$", name)
+}
+
+valid_label_values(values) {
+	is_array(values)
+	every value in values { is_string(value) }
+}
+
+valid_metric_declaration(declaration) {
+	is_object(declaration)
+	count(declaration) <= max_metrics_per_policy
+	every name, labels in declaration {
+		valid_metric_name(name)
+		is_object(labels)
+		every label, values in labels {
+			valid_metric_name(label)
+			valid_label_values(values)
+		}
+		product([count(values) | some values in labels]) <= max_series_per_metric
+	}
+}
+
+valid_metrics(policy, emitted) {
+	is_object(emitted)
+	declaration := metric_declarations[policy]
+	every name, labels in emitted {
+		is_object(labels)
+		count(labels) == count(declaration[name])
+		every label, value in labels {
+			value in declaration[name][label]
+		}
+	}
+}
+
+invalid_metrics = {policy |
+	data.docker_socket_authorizer[policy].metric_labels
+	not metric_declarations[policy]
+}
+
+# Unlike the rest of the meta-policy, this is evaluated for each request and never feeds ok: a policy emitting metrics
+# it did not declare only has those metrics dropped
+rejected_metrics = {policy |
+	emitted := data.docker_socket_authorizer[policy].metrics
+	not valid_metrics(policy, emitted)
+}
+
 ok {
 	count(invalid_policies) == 0
 	count(invalid_storage) == 0
+	count(invalid_metrics) == 0
 	count(ok_policies) > 0
 }
 `
 
+// The outcome of an attempt to load policies
+type PolicyLoad struct {
+	Time  time.Time
+	Error error // nil if the policies loaded successfully
+}
+
 type PolicyWatcher struct {
 	watcher         *fsnotify.Watcher
 	shutdownChannel chan struct{}
@@ -124,7 +227,7 @@ func WatchPolicies() (*PolicyWatcher, error) {
 	go handlePolicyFileChange(watcher)
 	go handlePolicyWatcherClose(watcher, shutdownPWChannel)
 
-	for _, dir := range cfg.Policy.Directories {
+	for _, dir := range append(append([]string{}, cfg.Policy.Directories...), cfg.Policy.Shadow.Directories...) {
 		err = watcher.Add(dir)
 		if err != nil {
 			slog.Error("Unable to establish policy watcher", slog.Any("error", err))
@@ -173,6 +276,11 @@ func handlePolicyFileChange(watcher *fsnotify.Watcher) {
 }
 
 func InitializePolicies(cfg *config.Configuration) error {
+	// Export every reason from the start, so increases can be alerted on
+	for _, reason := range POLICY_LOAD_FAILURE_REASONS {
+		o11y.Metrics.PolicyLoadFailures.WithLabelValues(reason)
+	}
+
 	if err := LoadPolicies(); err != nil {
 		return err
 	}
@@ -196,15 +304,51 @@ func LoadPolicies() error {
 
 	cfg := config.ConfigurationPointer.Load()
 
+	defer systemd.NotifyReloading()()
+
 	loadPoliciesMutex.Lock()
 	defer loadPoliciesMutex.Unlock()
 	o11y.Metrics.PolicyMutexWaitTimer.Observe(time.Since(startTime).Seconds())
 
 	e, err := NewEvaluator(rego.Load(cfg.Policy.Directories, nil))
 	if err != nil {
+		reason := POLICY_LOAD_FAILURE_OTHER
+		var loadErr *PolicyLoadError
+		if errors.As(err, &loadErr) {
+			reason = loadErr.Reason
+		}
+		o11y.Metrics.PolicyLoadFailures.WithLabelValues(reason).Inc()
+		o11y.Metrics.PolicyLoadFailing.Set(1)
+		LastPolicyLoad.Store(&PolicyLoad{Time: time.Now(), Error: err})
 		return err
 	}
-	Evaluator.Store(e)
+	e.owner = &Evaluator
+	previous := Evaluator.Swap(e)
+	LastPolicyLoad.Store(&PolicyLoad{Time: time.Now()})
+
+	o11y.Metrics.PolicyLoadFailing.Set(0)
+	o11y.Metrics.PolicyLastLoadTimestamp.SetToCurrentTime()
+	o11y.Metrics.PoliciesLoaded.Set(float64(len(e.policyList)))
+	o11y.Metrics.PolicyInfo.Reset()
+	o11y.Metrics.PolicyInfo.WithLabelValues(e.revision).Set(1)
+	o11y.RegisterPolicyCounters(e.metricDeclarations)
+	ResetProfile(e.revision)
+	ResetCoverage(e.revision)
+
+	// Policy results keep counting across reloads, except for policies which no longer exist, which stop being exported
+	if previous != nil {
+		for _, policy := range previous.policyList {
+			if !slices.Contains(e.policyList, policy) {
+				o11y.Metrics.PolicyResults.DeletePartialMatch(prometheus.Labels{"policy": policy})
+			}
+		}
+	}
+
+	// Storage is reset along with the evaluator, so the storage metrics must be too
+	o11y.Metrics.StorageBytes.Reset()
+	for policy, size := range e.storageSizes {
+		o11y.Metrics.StorageBytes.WithLabelValues(policy).Set(float64(size))
+	}
 
 	// List all the modules except docker_socket_meta_policy
 	moduleList := make([]string, len(e.authorizer.Modules())-1)
@@ -216,8 +360,30 @@ func LoadPolicies() error {
 		moduleList[i] = key
 		i++
 	}
-	slog.Info("Policies loaded successfully", slog.Any("policies", e.policyList), slog.Any("files_evaluated", moduleList))
+	slog.Info("Policies loaded successfully", slog.Any("policies", e.policyList), slog.Any("files_evaluated", moduleList), slog.String("revision", e.revision))
+
+	loadShadowPolicies(cfg)
 
 	o11y.Metrics.PolicyLoads.Inc()
 	return nil
 }
+
+// Loads the shadow policies, if any. Failure to do so is logged, but never causes LoadPolicies to fail, as shadow
+// policies must never affect real decisions. Must be called with loadPoliciesMutex held.
+func loadShadowPolicies(cfg *config.Configuration) {
+	if len(cfg.Policy.Shadow.Directories) == 0 {
+		ShadowEvaluator.Store(nil)
+		return
+	}
+
+	e, err := NewEvaluator(rego.Load(cfg.Policy.Shadow.Directories, nil))
+	if err != nil {
+		// Comparing against stale shadow policies would be misleading, so we stop shadow evaluation entirely
+		ShadowEvaluator.Store(nil)
+		slog.Error("Unable to load shadow policies; shadow evaluation is disabled until they are loaded successfully", slog.Any("error", err))
+		return
+	}
+	e.owner = &ShadowEvaluator
+	ShadowEvaluator.Store(e)
+	slog.Info("Shadow policies loaded successfully", slog.Any("policies", e.policyList), slog.String("revision", e.revision))
+}
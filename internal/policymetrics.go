@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/open-policy-agent/opa/rego"
+	"golang.org/x/exp/slog"
+)
+
+// Increments the counters for each metric in the metrics output of bindings, and logs a warning for any policy in the
+// rejected_metrics output (whose metrics are dropped). Only the evaluator making real decisions records metrics.
+func RecordPolicyMetrics(evaluator *RegoEvaluator, bindings rego.Vars, logger *slog.Logger) {
+	if !evaluator.reportsMetrics() {
+		return
+	}
+
+	if rejectedMetrics, _ := bindings["rejected_metrics"].([]interface{}); len(rejectedMetrics) > 0 {
+		logger.Warn("Policies emitted metrics not allowed by their metric_labels; metrics not recorded", slog.Any("policies", rejectedMetrics))
+	}
+
+	policies, _ := bindings["metrics"].(map[string]interface{})
+	for policy, emitted := range policies {
+		metrics, _ := emitted.(map[string]interface{})
+		for metric, labels := range metrics {
+			labelValues := map[string]string{}
+			labelObject, _ := labels.(map[string]interface{})
+			for label, value := range labelObject {
+				if stringValue, ok := value.(string); ok {
+					labelValues[label] = stringValue
+				}
+			}
+			o11y.IncrementPolicyCounter(policy, metric, labelValues)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/open-policy-agent/opa/profiler"
+)
+
+// The criteria by which profiled expressions can be ranked, in order of precedence when the first is tied
+var PROFILE_SORT_CRITERIA = []string{"total_time_ns", "num_eval", "num_redo"}
+
+// Profiling statistics for a single expression, summed across every sampled evaluation
+type ProfiledExpression struct {
+	File        string `json:"file"`
+	Row         int    `json:"row"`
+	Text        string `json:"text"`
+	TotalTimeNs int64  `json:"total_time_ns"`
+	NumEval     int    `json:"num_eval"`
+	NumRedo     int    `json:"num_redo"`
+	NumGenExpr  int    `json:"num_gen_expr"`
+}
+
+type ProfileReport struct {
+	Revision    string               `json:"revision"`
+	Since       time.Time            `json:"since"`
+	Samples     int                  `json:"samples"`
+	SampleEvery int                  `json:"sample_every"`
+	SortedBy    string               `json:"sorted_by"`
+	Expressions []ProfiledExpression `json:"expressions"`
+}
+
+type profileLocation struct {
+	file string
+	row  int
+}
+
+// Aggregated across evaluations by the current Evaluator; reset whenever policies are loaded
+var policyProfile = struct {
+	mutex       *sync.Mutex
+	revision    string
+	since       time.Time
+	samples     int
+	expressions map[profileLocation]*ProfiledExpression
+}{
+	mutex:       &sync.Mutex{},
+	since:       time.Now(),
+	expressions: map[profileLocation]*ProfiledExpression{},
+}
+
+var evaluationsSinceProfiled = &atomic.Uint64{}
+
+// Returns a new profiler if this evaluation should be profiled, according to policy.profiling, or nil if not. A
+// non-nil profiler should be passed to EvaluateQuery with rego.EvalQueryTracer, then to RecordProfile.
+func SampleProfiler() *profiler.Profiler {
+	cfg := config.ConfigurationPointer.Load()
+	if !cfg.Policy.Profiling.Enabled || cfg.Policy.Profiling.SampleEvery <= 0 {
+		return nil
+	}
+	if evaluationsSinceProfiled.Add(1)%uint64(cfg.Policy.Profiling.SampleEvery) != 0 {
+		return nil
+	}
+	return profiler.New()
+}
+
+// Adds the statistics collected by p during an evaluation by evaluator to the aggregated profile. Samples from an
+// evaluator which is no longer in use are discarded, as their locations may not match the current policies.
+func RecordProfile(evaluator *RegoEvaluator, p *profiler.Profiler) {
+	if !evaluator.reportsMetrics() || evaluator.isStale() {
+		return
+	}
+	report := p.ReportByFile()
+
+	policyProfile.mutex.Lock()
+	defer policyProfile.mutex.Unlock()
+	if policyProfile.revision != evaluator.revision {
+		return
+	}
+	policyProfile.samples++
+	for file, fileReport := range report.Files {
+		if file == "" {
+			// As OPA's own traces label it
+			file = "query"
+		}
+		for _, stats := range fileReport.Result {
+			location := profileLocation{file: file, row: stats.Location.Row}
+			expression, ok := policyProfile.expressions[location]
+			if !ok {
+				expression = &ProfiledExpression{File: file, Row: stats.Location.Row, Text: string(stats.Location.Text)}
+				policyProfile.expressions[location] = expression
+			}
+			expression.TotalTimeNs += stats.ExprTimeNs
+			expression.NumEval += stats.NumEval
+			expression.NumRedo += stats.NumRedo
+			if stats.NumGenExpr > expression.NumGenExpr {
+				expression.NumGenExpr = stats.NumGenExpr
+			}
+		}
+	}
+}
+
+// Discards the aggregated profile, and starts a new one for the policies with the given revision.
+func ResetProfile(revision string) {
+	policyProfile.mutex.Lock()
+	defer policyProfile.mutex.Unlock()
+	policyProfile.revision = revision
+	policyProfile.since = time.Now()
+	policyProfile.samples = 0
+	policyProfile.expressions = map[profileLocation]*ProfiledExpression{}
+}
+
+// Returns the top n expressions in the aggregated profile (or all of them, if n <= 0), ranked by sortBy, which must
+// be one of PROFILE_SORT_CRITERIA.
+func TopProfiledExpressions(n int, sortBy string) ProfileReport {
+	policyProfile.mutex.Lock()
+	expressions := make([]ProfiledExpression, 0, len(policyProfile.expressions))
+	for _, expression := range policyProfile.expressions {
+		expressions = append(expressions, *expression)
+	}
+	report := ProfileReport{
+		Revision:    policyProfile.revision,
+		Since:       policyProfile.since,
+		Samples:     policyProfile.samples,
+		SampleEvery: config.ConfigurationPointer.Load().Policy.Profiling.SampleEvery,
+		SortedBy:    sortBy,
+	}
+	policyProfile.mutex.Unlock()
+
+	keys := map[string]func(ProfiledExpression) int64{
+		"total_time_ns": func(e ProfiledExpression) int64 { return e.TotalTimeNs },
+		"num_eval":      func(e ProfiledExpression) int64 { return int64(e.NumEval) },
+		"num_redo":      func(e ProfiledExpression) int64 { return int64(e.NumRedo) },
+	}
+	order := []string{sortBy}
+	for _, criterion := range PROFILE_SORT_CRITERIA {
+		if criterion != sortBy {
+			order = append(order, criterion)
+		}
+	}
+	sort.Slice(expressions, func(i, j int) bool {
+		for _, criterion := range order {
+			if a, b := keys[criterion](expressions[i]), keys[criterion](expressions[j]); a != b {
+				return a > b
+			}
+		}
+		if expressions[i].File != expressions[j].File {
+			return expressions[i].File < expressions[j].File
+		}
+		return expressions[i].Row < expressions[j].Row
+	})
+
+	if n > 0 && n < len(expressions) {
+		expressions = expressions[:n]
+	}
+	report.Expressions = expressions
+	return report
+}
@@ -0,0 +1,97 @@
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/jsonpath"
+	"golang.org/x/exp/slog"
+)
+
+// The value that replaces masked values
+const MASK = "**REDACTED**"
+
+type rules struct {
+	cfg  *config.Configuration
+	mask []jsonpath.Path
+	drop []jsonpath.Path
+	hash []jsonpath.Path
+}
+
+// Parsed rules for the configuration they were parsed from, so we only parse (and warn about) them once per
+// configuration load
+var cachedRules atomic.Pointer[rules] = atomic.Pointer[rules]{}
+
+func currentRules() *rules {
+	cfg := config.ConfigurationPointer.Load()
+	if r := cachedRules.Load(); r != nil && r.cfg == cfg {
+		return r
+	}
+
+	r := &rules{cfg: cfg}
+	var err error
+	if r.mask, err = jsonpath.ParseAll(cfg.Redaction.Mask); err != nil {
+		slog.Warn("Ignoring invalid paths in redaction.mask", slog.Any("error", err))
+	}
+	if r.drop, err = jsonpath.ParseAll(cfg.Redaction.Drop); err != nil {
+		slog.Warn("Ignoring invalid paths in redaction.drop", slog.Any("error", err))
+	}
+	if r.hash, err = jsonpath.ParseAll(cfg.Redaction.Hash); err != nil {
+		slog.Warn("Ignoring invalid paths in redaction.hash", slog.Any("error", err))
+	}
+	// If we lose this race, we'll just parse again next time
+	cachedRules.Store(r)
+	return r
+}
+
+// Returns a redacted copy of document, in the form produced by jsonpath.ToJSONValue, along with the paths (as JSON
+// pointers) of values that were masked or hashed, and of values that were erased. Paths in the redaction
+// configuration are relative to document.
+func Redact(document interface{}) (redacted interface{}, masked []string, erased []string, err error) {
+	redacted, err = jsonpath.ToJSONValue(document)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	r := currentRules()
+	for _, path := range r.drop {
+		for _, matched := range path.Replace(redacted, func(interface{}) (interface{}, bool) { return nil, false }) {
+			erased = append(erased, matched.String())
+		}
+	}
+	for _, path := range r.hash {
+		for _, matched := range path.Replace(redacted, hashValue) {
+			masked = append(masked, matched.String())
+		}
+	}
+	for _, path := range r.mask {
+		for _, matched := range path.Replace(redacted, func(interface{}) (interface{}, bool) { return MASK, true }) {
+			masked = append(masked, matched.String())
+		}
+	}
+
+	return redacted, masked, erased, nil
+}
+
+// Returns a redacted copy of input, applying the redaction rules as they would be applied to the input of a decision
+// (i.e. to paths starting with "input").
+func RedactInput(input interface{}) (interface{}, error) {
+	redacted, _, _, err := Redact(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	return redacted.(map[string]interface{})["input"], nil
+}
+
+// Replaces value with a hash of its JSON serialization, so equal values can still be correlated without being revealed
+func hashValue(value interface{}) (interface{}, bool) {
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return MASK, true
+	}
+	hash := sha256.Sum256(serialized)
+	return "sha256:" + hex.EncodeToString(hash[:]), true
+}
@@ -0,0 +1,148 @@
+package redact
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+)
+
+func TestRedact(t *testing.T) {
+	document := `{
+		"input": {
+			"request": {
+				"headers": {"authorization": ["secret"], "x-original-uri": ["/v1.43/containers/json"]},
+				"users": [{"name": "alice", "password": "a"}, {"name": "bob", "password": "b"}]
+			}
+		},
+		"result": {"ok": true}
+	}`
+
+	tests := []struct {
+		name     string
+		mask     []string
+		drop     []string
+		hash     []string
+		expected string
+		masked   []string
+		erased   []string
+	}{
+		{
+			name:     "nothing configured",
+			expected: document,
+		},
+		{
+			name: "mask",
+			mask: []string{"input.request.headers.authorization"},
+			expected: `{
+				"input": {
+					"request": {
+						"headers": {"authorization": "**REDACTED**", "x-original-uri": ["/v1.43/containers/json"]},
+						"users": [{"name": "alice", "password": "a"}, {"name": "bob", "password": "b"}]
+					}
+				},
+				"result": {"ok": true}
+			}`,
+			masked: []string{"/input/request/headers/authorization"},
+		},
+		{
+			name: "drop with glob over array",
+			drop: []string{"/input/request/users/*/password"},
+			expected: `{
+				"input": {
+					"request": {
+						"headers": {"authorization": ["secret"], "x-original-uri": ["/v1.43/containers/json"]},
+						"users": [{"name": "alice"}, {"name": "bob"}]
+					}
+				},
+				"result": {"ok": true}
+			}`,
+			erased: []string{"/input/request/users/0/password", "/input/request/users/1/password"},
+		},
+		{
+			name: "hash",
+			hash: []string{"input.request.headers.authorization", "input.request.users.0.name"},
+			expected: `{
+				"input": {
+					"request": {
+						"headers": {"authorization": "sha256:7ed6936249ddb5c87cc52acf02d9c1fe7ea39bf6cf31c3dedee02ec26dfc7b92", "x-original-uri": ["/v1.43/containers/json"]},
+						"users": [{"name": "sha256:0a50500b2a3435fe7472877eb22d48d47a228e946b0b991ab7402a8d00f6b32d", "password": "a"}, {"name": "bob", "password": "b"}]
+					}
+				},
+				"result": {"ok": true}
+			}`,
+			masked: []string{"/input/request/headers/authorization", "/input/request/users/0/name"},
+		},
+		{
+			name: "drop takes precedence",
+			mask: []string{"input.request.headers.*"},
+			drop: []string{"input.request.headers.authorization"},
+			expected: `{
+				"input": {
+					"request": {
+						"headers": {"x-original-uri": "**REDACTED**"},
+						"users": [{"name": "alice", "password": "a"}, {"name": "bob", "password": "b"}]
+					}
+				},
+				"result": {"ok": true}
+			}`,
+			masked: []string{"/input/request/headers/x-original-uri"},
+			erased: []string{"/input/request/headers/authorization"},
+		},
+		{
+			name: "invalid paths are ignored",
+			mask: []string{"input.[", "result.ok"},
+			expected: `{
+				"input": {
+					"request": {
+						"headers": {"authorization": ["secret"], "x-original-uri": ["/v1.43/containers/json"]},
+						"users": [{"name": "alice", "password": "a"}, {"name": "bob", "password": "b"}]
+					}
+				},
+				"result": {"ok": "**REDACTED**"}
+			}`,
+			masked: []string{"/result/ok"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config.DefaultConfiguration()
+			cfg.Redaction.Mask = test.mask
+			cfg.Redaction.Drop = test.drop
+			cfg.Redaction.Hash = test.hash
+			config.ConfigurationPointer.Store(cfg)
+
+			original := unmarshal(t, document)
+			redacted, masked, erased, err := Redact(original)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(redacted, unmarshal(t, test.expected)) {
+				t.Fatalf("expected %s, got %v", test.expected, redacted)
+			}
+			if !reflect.DeepEqual(original, unmarshal(t, document)) {
+				t.Fatalf("the original document was modified: %v", original)
+			}
+			sort.Strings(masked)
+			sort.Strings(erased)
+			if !reflect.DeepEqual(masked, test.masked) {
+				t.Fatalf("expected masked %v, got %v", test.masked, masked)
+			}
+			if !reflect.DeepEqual(erased, test.erased) {
+				t.Fatalf("expected erased %v, got %v", test.erased, erased)
+			}
+		})
+	}
+}
+
+func unmarshal(t *testing.T, document string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
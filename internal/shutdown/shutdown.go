@@ -5,10 +5,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mjec/docker-socket-authorizer/config"
 	"golang.org/x/exp/slog"
 )
 
-const TIMEOUT_SECONDS float64 = 1
+// How long to wait for shutdown hooks to complete, in addition to the time allowed for servers to drain
+const GRACE_SECONDS float64 = 1
 
 type gracefulShutdownManager struct {
 	shutdownOnce    *sync.Once
@@ -17,6 +19,7 @@ type gracefulShutdownManager struct {
 	onShutdown      map[string]func()
 	onShutdownLock  *sync.Mutex
 	waitOnce        *sync.Once
+	draining        *sync.WaitGroup
 }
 
 type waitGroupKeyT struct{}
@@ -30,6 +33,7 @@ var shutdownManager gracefulShutdownManager = gracefulShutdownManager{
 	onShutdown:      map[string]func(){},
 	onShutdownLock:  &sync.Mutex{},
 	waitOnce:        &sync.Once{},
+	draining:        &sync.WaitGroup{},
 }
 
 // Receives functions to run as goroutines on shutdown. If f is nil, the function registered under key is removed.
@@ -61,7 +65,7 @@ func Shutdown(reason string, logLevel slog.Level, logger *slog.Logger) bool {
 		waitGroup := sync.WaitGroup{}
 		shuttingDownContext, cancelShutdown := context.WithTimeout(
 			context.WithValue(context.Background(), waitGroupKey, &waitGroup),
-			time.Duration(TIMEOUT_SECONDS*float64(time.Second)),
+			DrainTimeout()+time.Duration(GRACE_SECONDS*float64(time.Second)),
 		)
 
 		if logger == nil {
@@ -88,7 +92,7 @@ func Shutdown(reason string, logLevel slog.Level, logger *slog.Logger) bool {
 		go func(ctx context.Context) {
 			<-ctx.Done()
 			if ctx.Err() == context.DeadlineExceeded {
-				slog.Warn("Shutdown hooks did not complete before timeout; exiting anyway", slog.Float64("timeout_seconds", TIMEOUT_SECONDS))
+				slog.Warn("Shutdown hooks did not complete before timeout; exiting anyway", slog.Float64("timeout_seconds", DrainTimeout().Seconds()+GRACE_SECONDS))
 			}
 			shutdownManager.shutdownChannel <- struct{}{}
 			close(shutdownManager.shutdownChannel)
@@ -105,3 +109,36 @@ func WaitForShutdown() {
 		<-shutdownManager.shutdownChannel
 	})
 }
+
+// Returns how long servers may take to finish in-flight requests on shutdown, set by server.drain_timeout_seconds
+func DrainTimeout() time.Duration {
+	cfg := config.ConfigurationPointer.Load()
+	if cfg == nil {
+		cfg = config.DefaultConfiguration()
+	}
+	return time.Duration(cfg.Server.DrainTimeoutSeconds) * time.Second
+}
+
+// Returns a context with the deadline by which shutdown hooks must complete, for hooks which need to give up on slow
+// work rather than be cut off part way through it. Before shutdown starts, returns a context with no deadline.
+func Context() context.Context {
+	shutdownManager.onShutdownLock.Lock()
+	defer shutdownManager.onShutdownLock.Unlock()
+	if shutdownManager.shutdownContext == nil {
+		return context.Background()
+	}
+	return *shutdownManager.shutdownContext
+}
+
+// Records that a server must drain before shutdown hooks which call WaitForDrain can proceed. The returned function
+// must be called once the server has drained (or given up).
+func Draining() func() {
+	shutdownManager.draining.Add(1)
+	return shutdownManager.draining.Done
+}
+
+// Blocks until every server registered with Draining has drained, for shutdown hooks which must not run while requests
+// are still in flight (for example, closing the decision log).
+func WaitForDrain() {
+	shutdownManager.draining.Wait()
+}
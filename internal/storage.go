@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/mjec/docker-socket-authorizer/config"
+	"github.com/mjec/docker-socket-authorizer/internal/o11y"
+	"github.com/open-policy-agent/opa/rego"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// Checks the to_store output in bindings against the configured storage quotas, and applies the behavior set by
+// storage.on_quota_exceeded to any policy that breaches them:
+// - "reject": the policy's data is not stored, and a warning is logged
+// - "invalid": the policy's data is not stored, and the policy is treated as though it were in invalid_storage, which
+// causes the request to be denied
+// - "fail": an error is returned, which should cause the request to fail
+// In every case bindings is modified in place so that to_store only contains data that is safe to write.
+func EnforceStorageQuotas(evaluator *RegoEvaluator, bindings rego.Vars, logger *slog.Logger) error {
+	cfg := config.ConfigurationPointer.Load()
+	toStore := bindings["to_store"].(map[string]interface{})
+
+	violations, err := evaluator.StorageQuotaViolations(toStore)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	policies := maps.Keys(violations)
+	slices.Sort(policies)
+	for _, policy := range policies {
+		if evaluator.reportsMetrics() {
+			o11y.Metrics.StorageQuotaBreaches.WithLabelValues(policy).Inc()
+		}
+		delete(toStore, policy)
+	}
+
+	switch cfg.Storage.OnQuotaExceeded {
+	case "fail":
+		return fmt.Errorf("storage quota exceeded: %v", violations)
+	case "invalid":
+		invalidStorage, _ := bindings["invalid_storage"].([]interface{})
+		for _, policy := range policies {
+			if !slices.Contains(invalidStorage, interface{}(policy)) {
+				invalidStorage = append(invalidStorage, policy)
+			}
+		}
+		bindings["invalid_storage"] = invalidStorage
+		if okConditions, ok := bindings["ok_conditions"].(map[string]interface{}); ok {
+			okConditions["no invalid storages"] = false
+		}
+		bindings["ok"] = false
+		logger.Warn("Storage quota exceeded; treating policies as having invalid storage", slog.Any("violations", violations))
+	case "reject":
+		logger.Warn("Storage quota exceeded; data not stored", slog.Any("violations", violations))
+	default:
+		logger.Warn("Storage quota exceeded; data not stored (unsupported storage.on_quota_exceeded configuration value, defaulting to reject)", slog.Any("violations", violations), slog.String("on_quota_exceeded", cfg.Storage.OnQuotaExceeded))
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/exp/slog"
+)
+
+// The first file descriptor passed by socket activation; see sd_listen_fds(3)
+const LISTEN_FDS_START = 3
+
+// Sockets passed to us by socket activation, by name; each can only be used by one listener
+var activated = struct {
+	once      *sync.Once
+	mutex     *sync.Mutex
+	listeners map[string]net.Listener
+}{
+	once:      &sync.Once{},
+	mutex:     &sync.Mutex{},
+	listeners: map[string]net.Listener{},
+}
+
+// Returns the listening socket named name, which was passed to us by systemd socket activation (see
+// systemd.socket(5)). The name is set by FileDescriptorName= in the .socket unit, and defaults to the name of the
+// unit (such as docker-socket-authorizer.socket).
+func Listener(name string) (net.Listener, error) {
+	activated.once.Do(collectActivatedListeners)
+
+	activated.mutex.Lock()
+	defer activated.mutex.Unlock()
+	listener, ok := activated.listeners[name]
+	if !ok {
+		available := make([]string, 0, len(activated.listeners))
+		for name := range activated.listeners {
+			available = append(available, name)
+		}
+		return nil, fmt.Errorf("no socket named %q was passed by systemd (available: %s)", name, strings.Join(available, ", "))
+	}
+	delete(activated.listeners, name)
+	return listener, nil
+}
+
+func collectActivatedListeners() {
+	// As sd_listen_fds(3) does, so these aren't inherited by any child processes
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		fd := LISTEN_FDS_START + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), name)
+		// FileListener duplicates the file descriptor, so we close the original either way
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			slog.Warn("Unable to use socket passed by systemd", slog.String("name", name), slog.Int("fd", fd), slog.Any("error", err))
+			continue
+		}
+		if _, exists := activated.listeners[name]; exists {
+			slog.Warn("Ignoring socket passed by systemd with a duplicate name", slog.String("name", name), slog.Int("fd", fd))
+			listener.Close()
+			continue
+		}
+		activated.listeners[name] = listener
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package systemd
+
+import (
+	"errors"
+	"net"
+)
+
+// Socket activation is only implemented for Linux, so the "systemd" listener type can't be used elsewhere
+func Listener(_ string) (net.Listener, error) {
+	return nil, errors.New("systemd socket activation is only supported on linux")
+}
@@ -0,0 +1,109 @@
+//go:build linux
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sys/unix"
+)
+
+// Set once READY=1 has been sent, after which reloads are reported with RELOADING=1
+var ready = &atomic.Bool{}
+
+// Sends state to the service manager using the sd_notify protocol (see sd_notify(3)), if we were started with
+// NOTIFY_SOCKET set (for example, by a systemd service with Type=notify); otherwise does nothing.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// An abstract socket
+		socket = "\x00" + socket[1:]
+	}
+
+	connection, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	_, err = connection.Write([]byte(state))
+	return err
+}
+
+// Starts sending watchdog pings if the service manager asked for them by setting WATCHDOG_USEC, and arranges to send
+// STOPPING=1 when we start shutting down.
+func InitializeSystemd() error {
+	defer shutdown.OnShutdown("systemd", func() {
+		notifyOrLog("STOPPING=1")
+	})
+
+	interval, err := watchdogInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+	// Ping twice per interval, as recommended by sd_watchdog_enabled(3), so one late ping doesn't get us killed
+	ticker := time.NewTicker(interval / 2)
+	defer shutdown.OnShutdown("systemd watchdog", ticker.Stop)
+	go func() {
+		for range ticker.C {
+			notifyOrLog("WATCHDOG=1")
+		}
+	}()
+	slog.Debug("Sending systemd watchdog pings", slog.Duration("interval", interval))
+	return nil
+}
+
+// Sends READY=1, once we are able to serve requests.
+func NotifyReady() {
+	notifyOrLog("READY=1")
+	ready.Store(true)
+}
+
+// Sends RELOADING=1, if we have already sent READY=1, and returns a function to send READY=1 again once the reload is
+// complete (whether or not it succeeded). It is idiomatic to use `defer systemd.NotifyReloading()()`.
+func NotifyReloading() func() {
+	if !ready.Load() {
+		return func() {}
+	}
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		slog.Warn("Unable to read monotonic clock for systemd notification", slog.Any("error", err))
+	}
+	// MONOTONIC_USEC is required by Type=notify-reload services
+	notifyOrLog(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", now.Nano()/int64(time.Microsecond)))
+	return func() {
+		notifyOrLog("READY=1")
+	}
+}
+
+func notifyOrLog(state string) {
+	if err := Notify(state); err != nil {
+		slog.Warn("Unable to notify systemd", slog.String("state", state), slog.Any("error", err))
+	}
+}
+
+// Returns the interval in which the service manager expects watchdog pings, or 0 if it doesn't
+func watchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// Meant for some other process
+		return 0, nil
+	}
+	value, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(value) * time.Microsecond, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package systemd
+
+// The sd_notify protocol is only implemented for Linux, so these do nothing elsewhere
+
+func Notify(_ string) error {
+	return nil
+}
+
+func InitializeSystemd() error {
+	return nil
+}
+
+func NotifyReady() {}
+
+func NotifyReloading() func() {
+	return func() {}
+}
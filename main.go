@@ -5,16 +5,41 @@ import (
 
 	"github.com/mjec/docker-socket-authorizer/internal"
 	"github.com/mjec/docker-socket-authorizer/internal/authsvr"
+	"github.com/mjec/docker-socket-authorizer/internal/commands"
+	"github.com/mjec/docker-socket-authorizer/internal/decisionlog"
 	"github.com/mjec/docker-socket-authorizer/internal/lifecycle"
+	"github.com/mjec/docker-socket-authorizer/internal/listener"
 	"github.com/mjec/docker-socket-authorizer/internal/o11y"
 	"github.com/mjec/docker-socket-authorizer/internal/shutdown"
+	"github.com/mjec/docker-socket-authorizer/internal/systemd"
 	"golang.org/x/exp/slog"
 )
 
 func main() {
+	// Any other arguments are ignored, as they always have been, so existing service definitions keep working
+	if len(os.Args) > 1 {
+		if command, ok := commands.Commands[os.Args[1]]; ok {
+			os.Exit(command.Run(os.Args[2:]))
+		}
+		if os.Args[1] == "help" {
+			commands.PrintUsage(os.Stdout)
+			os.Exit(0)
+		}
+	}
+
 	cfg := lifecycle.Bootstrap()
 	lifecycle.InitializeSignalHandler(&cfg)
 
+	if err := systemd.InitializeSystemd(); err != nil {
+		slog.Error("Unable to initialize systemd integration", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	if err := decisionlog.InitializeDecisionLog(&cfg); err != nil {
+		slog.Error("Unable to initialize decision log", slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	if err := internal.InitializePolicies(&cfg); err != nil {
 		slog.Error("Unable to initialize policies", slog.Any("error", err))
 		os.Exit(1)
@@ -25,10 +50,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := o11y.InitializeTracing(&cfg); err != nil {
+		slog.Error("Unable to initialize tracing", slog.Any("error", err))
+		os.Exit(1)
+	}
+
 	if err := authsvr.InitializeAuthServer(&cfg); err != nil {
 		slog.Error("Unable to initialize authorization server", slog.Any("error", err))
 		os.Exit(1)
 	}
 
+	// Policies have loaded and every listener is up, so we can serve requests
+	listener.FinishedStarting()
+	systemd.NotifyReady()
+
 	shutdown.WaitForShutdown()
 }